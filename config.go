@@ -1,7 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	config "github.com/micro/go-config"
 	"github.com/micro/go-config/source/file"
@@ -9,11 +13,35 @@ import (
 
 // LDAPServer is a LDAP server
 type LDAPServer struct {
-	Address      string `json:"address"`
-	Port         int    `json:"port"`
-	StartTLS     bool   `json:"start_tls"`
-	BindDN       string `json:"bind_dn"`
-	BindPassword string `json:"bind_password"`
+	Address            string `json:"address"`
+	Port               int    `json:"port"`
+	Mode               string `json:"mode"`      // One of plain, starttls or ldaps
+	StartTLS           bool   `json:"start_tls"` // Deprecated: equivalent to mode starttls when mode is not set
+	BindDN             string `json:"bind_dn"`
+	BindPassword       string `json:"bind_password"`
+	CAFile             string `json:"ca_file"`              // PEM bundle of CAs to verify the server certificate against
+	CADir              string `json:"ca_dir"`               // Directory of PEM files of CAs to verify the server certificate against
+	ServerName         string `json:"server_name"`          // Expected name in the server certificate, defaults to Address
+	MinTLSVersion      string `json:"min_tls_version"`      // One of 1.0, 1.1, 1.2, 1.3, defaults to 1.2
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Disable server certificate verification
+}
+
+// LDAP connection modes
+const (
+	LDAPModePlain    = "plain"
+	LDAPModeStartTLS = "starttls"
+	LDAPModeLDAPS    = "ldaps"
+)
+
+// connMode returns the connection mode of the server, falling back to StartTLS when Mode is unset.
+func (s *LDAPServer) connMode() string {
+	if s.Mode != "" {
+		return s.Mode
+	}
+	if s.StartTLS {
+		return LDAPModeStartTLS
+	}
+	return LDAPModePlain
 }
 
 // LDAPUserSearch is the config attributes to search for users in the LDAP tree
@@ -26,18 +54,103 @@ type LDAPUserSearch struct {
 	FullNameAttr        string `json:"full_name_attr"`
 	FirstNameAttr       string `json:"first_name_attr"`
 	LastNameAttr        string `json:"last_name_attr"`
+	PageSize            uint32 `json:"page_size"` // Number of entries per page of search results, defaults to 500
+
+	// Only sync users that are members of at least one of IncludeGroups, if set, and none of ExcludeGroups.
+	// Groups are given by DN or by the group_attr of LDAPGroupSearch.
+	IncludeGroups []string `json:"include_groups"`
+	ExcludeGroups []string `json:"exclude_groups"`
+
+	// Detect disabled LDAP accounts, which are created or updated in Duo with status disabled. DisabledPresets are
+	// any of ad, 389ds, ppolicy or shadow. A custom DisabledAttr marks an account disabled if it has any of
+	// DisabledValues, compared case insensitively, or if it is present at all when DisabledValues is empty.
+	DisabledPresets []string `json:"disabled_presets"`
+	DisabledAttr    string   `json:"disabled_attr"`
+	DisabledValues  []string `json:"disabled_values"`
+}
+
+// defaultPageSize is the page size used for LDAP searches when PageSize of LDAPUserSearch or LDAPGroupSearch is unset
+const defaultPageSize = 500
+
+// pageSize returns the configured page size for user searches, or defaultPageSize if unset.
+func (c *LDAPUserSearch) pageSize() uint32 {
+	if c.PageSize > 0 {
+		return c.PageSize
+	}
+	return defaultPageSize
 }
 
 // LDAPGroupSearch is the config attributes to search for groups in the LDAP tree
 type LDAPGroupSearch struct {
 	BaseDN      string `json:"base_dn"`
 	GroupFilter string `json:"group_filter"`
-	GroupAttr   string `json:"group_attr"` // Attribute to match an individual group
+	GroupAttr   string `json:"group_attr"`  // Attribute to match an individual group, used as the Duo group name
+	DescAttr    string `json:"desc_attr"`   // Attribute synced to the Duo group description, defaults to description
+	Membership  string `json:"membership"`  // One of memberof, member or memberuid, see membership()
+	MemberAttr  string `json:"member_attr"` // Attribute of a group listing its members, defaults to member or memberUid based on Membership
+	PageSize    uint32 `json:"page_size"`   // Number of entries per page of search results, defaults to 500
+
+	// Resolve membership through nested groups. Active Directory's LDAP_MATCHING_RULE_IN_CHAIN is used when available,
+	// otherwise the group graph is walked using MemberAttr and the group membership attribute of LDAPUserSearch.
+	NestedGroups bool `json:"nested_groups"`
+}
+
+// Group membership models
+const (
+	MembershipMemberOf  = "memberof"  // Users list their groups by DN in the group_membership_attr of LDAPUserSearch
+	MembershipMember    = "member"    // Groups list their members by DN, eg. member or uniqueMember
+	MembershipMemberUID = "memberuid" // Groups list their members by username, eg. posixGroup memberUid
+)
+
+// membership returns the configured group membership model. When unset, memberuid is used if MemberAttr is memberUid,
+// member if MemberAttr is set to anything else, and memberof otherwise.
+func (c *LDAPGroupSearch) membership() string {
+	if c.Membership != "" {
+		return c.Membership
+	}
+	if strings.EqualFold(c.MemberAttr, "memberUid") {
+		return MembershipMemberUID
+	} else if c.MemberAttr != "" {
+		return MembershipMember
+	}
+	return MembershipMemberOf
+}
+
+// memberAttr returns the attribute of a group listing its members, if the membership model uses one.
+func (c *LDAPGroupSearch) memberAttr() string {
+	if c.MemberAttr != "" {
+		return c.MemberAttr
+	}
+	switch c.membership() {
+	case MembershipMember:
+		return "member"
+	case MembershipMemberUID:
+		return "memberUid"
+	}
+	return ""
+}
+
+// pageSize returns the configured page size for group searches, or defaultPageSize if unset.
+func (c *LDAPGroupSearch) pageSize() uint32 {
+	if c.PageSize > 0 {
+		return c.PageSize
+	}
+	return defaultPageSize
+}
+
+// descAttr returns the configured group description attribute, or description if unset.
+func (c *LDAPGroupSearch) descAttr() string {
+	if c.DescAttr != "" {
+		return c.DescAttr
+	}
+	return "description"
 }
 
 // DuoAPI is the config attributes to access and control behavior with the Duo Admin API
 type DuoAPI struct {
-	DeleteUsers        bool   `json:"delete_users"`
+	DeleteUsers        bool   `json:"delete_users"` // Deprecated: equivalent to deprovision delete when deprovision is not set
+	Deprovision        string `json:"deprovision"`  // One of delete, disable or none for Duo users no longer in LDAP
+	SyncGroups         bool   `json:"sync_groups"`  // Create, update and delete Duo groups from LDAP groups
 	SendEnrollEmail    bool   `json:"send_enroll_email"`
 	MaxDeleteUsers     int    `json:"max_delete_users"`
 	EnrollValidSeconds int    `json:"enroll_valid_seconds"`
@@ -45,14 +158,119 @@ type DuoAPI struct {
 	Skey               string `json:"skey"`
 	APIHost            string `json:"api_host"`
 	HTTPProxy          string `json:"http_proxy"`
+
+	// Only deprovision Duo users once they have been missing from LDAP for DeprovisionGraceCycles consecutive sync
+	// cycles and for the DeprovisionGrace duration, eg. 72h. Missing users are tracked in the state directory.
+	DeprovisionGraceCycles int    `json:"deprovision_grace_cycles"`
+	DeprovisionGrace       string `json:"deprovision_grace"`
+
+	// Send users who still haven't enrolled another enrollment email every EnrollReminderSeconds, up to
+	// MaxEnrollReminders times after the first email.
+	EnrollReminderSeconds int `json:"enroll_reminder_seconds"`
+	MaxEnrollReminders    int `json:"max_enroll_reminders"`
+
+	// Duo users that are never updated, disabled or deleted, like break-glass and service accounts
+	Protected *ProtectedUsers `json:"protected"`
+
+	// Users created by duoldapsync carry OwnershipMarker in their Duo notes, defaulting to [duoldapsync]. With
+	// Ownership set, only Duo users carrying the marker are updated, enrolled, disabled or deleted. The adopt
+	// command adds the marker to existing Duo users found in LDAP.
+	Ownership       bool   `json:"ownership"`
+	OwnershipMarker string `json:"ownership_marker"`
+}
+
+// ownershipMarker returns the configured ownership marker, or managedGroupMarker if unset.
+func (c *DuoAPI) ownershipMarker() string {
+	if c.OwnershipMarker != "" {
+		return c.OwnershipMarker
+	}
+	return managedGroupMarker
+}
+
+// planSettings returns the settings without the secret key and proxy, which may hold credentials, to be part of the
+// fingerprint of a Plan.
+func (c *DuoAPI) planSettings() DuoAPI {
+	settings := *c
+	settings.Skey = ""
+	settings.HTTPProxy = ""
+	return settings
+}
+
+// manages returns true if duoldapsync may change the user in Duo beyond creating it, which excludes protected users,
+// and Duo users without the ownership marker in ownership mode.
+func (c *DuoAPI) manages(user *User) bool {
+	if user.Protected {
+		return false
+	}
+	return !c.Ownership || !user.Duo || user.Owned
+}
+
+// ProtectedUsers matches Duo users by username, pattern or Duo group membership
+type ProtectedUsers struct {
+	Usernames []string `json:"usernames"` // Exact usernames
+	Patterns  []string `json:"patterns"`  // Glob patterns matched against usernames, eg. svc-*
+	Regexps   []string `json:"regexps"`   // Regular expressions matched against usernames, eg. ^admin[0-9]+$
+	Groups    []string `json:"groups"`    // Names of Duo groups
+}
+
+// Deprovisioning modes for Duo users no longer found in LDAP
+const (
+	DeprovisionDelete  = "delete"  // Delete the Duo user, including their enrolled phones and tokens
+	DeprovisionDisable = "disable" // Set the Duo user's status to disabled, re-enabling them if they reappear in LDAP
+	DeprovisionNone    = "none"    // Leave the Duo user alone
+)
+
+// deprovision returns the deprovisioning mode, falling back to DeleteUsers when Deprovision is unset.
+func (c *DuoAPI) deprovision() string {
+	if c.Deprovision != "" {
+		return c.Deprovision
+	}
+	if c.DeleteUsers {
+		return DeprovisionDelete
+	}
+	return DeprovisionNone
+}
+
+// graceDuration returns the parsed DeprovisionGrace, or 0 if unset or invalid.
+func (c *DuoAPI) graceDuration() time.Duration {
+	if c.DeprovisionGrace == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(c.DeprovisionGrace)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// hasGrace returns true if a grace period applies before deprovisioning users missing from LDAP.
+func (c *DuoAPI) hasGrace() bool {
+	return c.DeprovisionGraceCycles > 0 || c.graceDuration() > 0
 }
 
+// StateConfig is the config attributes for the state duoldapsync keeps on disk between sync cycles
+type StateConfig struct {
+	Dir string `json:"dir"` // Directory holding the state file, defaults to /var/lib/duoldapsync
+}
+
+// defaultStateDir is the state directory used when StateConfig.Dir is unset
+const defaultStateDir = "/var/lib/duoldapsync"
+
 // DuoLDAPSyncConfig is overall configuration struct for duoldapsync
 type DuoLDAPSyncConfig struct {
 	LDAPServers     []*LDAPServer
 	LDAPUserSearch  *LDAPUserSearch
 	LDAPGroupSearch *LDAPGroupSearch
 	DuoAPI          *DuoAPI
+	State           *StateConfig
+}
+
+// stateDir returns the configured state directory, or defaultStateDir if unset.
+func (c DuoLDAPSyncConfig) stateDir() string {
+	if c.State != nil && c.State.Dir != "" {
+		return c.State.Dir
+	}
+	return defaultStateDir
 }
 
 func loadConfig(path string) (DuoLDAPSyncConfig, error) {
@@ -86,6 +304,14 @@ func loadConfig(path string) (DuoLDAPSyncConfig, error) {
 		return c, err
 	}
 
+	if err := conf.Get("state").Scan(&c.State); err != nil {
+		return c, err
+	}
+
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+
 	if c.DuoAPI.HTTPProxy != "" {
 		os.Setenv("HTTPS_PROXY", c.DuoAPI.HTTPProxy)
 		os.Setenv("HTTP_PROXY", c.DuoAPI.HTTPProxy)
@@ -93,3 +319,102 @@ func loadConfig(path string) (DuoLDAPSyncConfig, error) {
 
 	return c, nil
 }
+
+// validate checks that the required configuration is present and usable.
+func (c DuoLDAPSyncConfig) validate() error {
+	if len(c.LDAPServers) == 0 {
+		return errors.New("at least one LDAP server must be configured in servers")
+	}
+	for i, server := range c.LDAPServers {
+		if server == nil || server.Address == "" {
+			return fmt.Errorf("servers[%d] requires an address", i)
+		}
+		switch server.connMode() {
+		case LDAPModePlain, LDAPModeStartTLS, LDAPModeLDAPS:
+		default:
+			return fmt.Errorf("unknown mode %q for LDAP server %s", server.Mode, server.Address)
+		}
+		// A bind DN without a password is an unauthenticated bind (RFC 4513), which most servers accept and then
+		// treat like an anonymous one
+		if server.BindDN != "" && server.BindPassword == "" {
+			return fmt.Errorf("bind_dn %s for LDAP server %s requires a bind_password", server.BindDN, server.Address)
+		}
+		if server.connMode() != LDAPModePlain {
+			if _, err := tlsConfig(server); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.LDAPUserSearch == nil {
+		return errors.New("user_search must be configured")
+	}
+	if c.LDAPUserSearch.BaseDN == "" || c.LDAPUserSearch.UserFilter == "" || c.LDAPUserSearch.UserAttr == "" {
+		return errors.New("user_search requires base_dn, user_filter and user_attr")
+	}
+
+	if c.DuoAPI == nil {
+		return errors.New("duo_api must be configured")
+	}
+	if c.DuoAPI.Ikey == "" || c.DuoAPI.Skey == "" || c.DuoAPI.APIHost == "" {
+		return errors.New("duo_api requires ikey, skey and api_host")
+	}
+
+	for _, preset := range c.LDAPUserSearch.DisabledPresets {
+		if _, ok := disabledPresets[preset]; !ok {
+			return fmt.Errorf("unknown user_search disabled_presets %q", preset)
+		}
+	}
+
+	switch c.DuoAPI.deprovision() {
+	case DeprovisionDelete, DeprovisionDisable, DeprovisionNone:
+	default:
+		return fmt.Errorf("unknown duo_api deprovision %q", c.DuoAPI.Deprovision)
+	}
+	if c.DuoAPI.DeprovisionGraceCycles < 0 {
+		return errors.New("duo_api deprovision_grace_cycles can't be negative")
+	}
+	if _, err := newProtectedMatcher(c.DuoAPI.Protected); err != nil {
+		return fmt.Errorf("duo_api protected: %v", err)
+	}
+	if c.DuoAPI.EnrollReminderSeconds < 0 || c.DuoAPI.MaxEnrollReminders < 0 {
+		return errors.New("duo_api enroll_reminder_seconds and max_enroll_reminders can't be negative")
+	}
+	if c.DuoAPI.DeprovisionGrace != "" {
+		if d, err := time.ParseDuration(c.DuoAPI.DeprovisionGrace); err != nil || d < 0 {
+			return fmt.Errorf("invalid duo_api deprovision_grace %q, expected a duration such as 72h", c.DuoAPI.DeprovisionGrace)
+		}
+	}
+
+	if c.groupsRequired() {
+		if c.LDAPGroupSearch == nil {
+			return errors.New("group_search must be configured when duo_api sync_groups, include_groups or exclude_groups are set")
+		}
+		if c.LDAPGroupSearch.BaseDN == "" || c.LDAPGroupSearch.GroupFilter == "" || c.LDAPGroupSearch.GroupAttr == "" {
+			return errors.New("group_search requires base_dn, group_filter and group_attr")
+		}
+		switch c.LDAPGroupSearch.membership() {
+		case MembershipMemberOf:
+			if c.LDAPUserSearch.GroupMembershipAttr == "" {
+				return errors.New("user_search group_membership_attr is required with group_search membership memberof")
+			}
+		case MembershipMember, MembershipMemberUID:
+		default:
+			return fmt.Errorf("unknown group_search membership %q", c.LDAPGroupSearch.Membership)
+		}
+	}
+
+	return nil
+}
+
+// stateRequired returns true if a sync cycle relies on the state to decide its changes: to wait out the deprovision
+// grace period, to avoid resending enrollment emails, or to re-enable only the users duoldapsync disabled.
+func (c DuoLDAPSyncConfig) stateRequired() bool {
+	return c.DuoAPI.hasGrace() || c.DuoAPI.SendEnrollEmail || c.DuoAPI.deprovision() == DeprovisionDisable ||
+		c.LDAPUserSearch.detectsDisabled()
+}
+
+// groupsRequired returns true if LDAP groups need to be enumerated each sync cycle.
+func (c DuoLDAPSyncConfig) groupsRequired() bool {
+	return c.DuoAPI.SyncGroups || len(c.LDAPUserSearch.IncludeGroups) > 0 || len(c.LDAPUserSearch.ExcludeGroups) > 0
+}
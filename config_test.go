@@ -0,0 +1,154 @@
+package main
+
+import "testing"
+
+func TestLDAPServer_connMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		server LDAPServer
+		want   string
+	}{
+		{name: "Default", server: LDAPServer{}, want: LDAPModePlain},
+		{name: "Legacy start_tls", server: LDAPServer{StartTLS: true}, want: LDAPModeStartTLS},
+		{name: "Mode overrides start_tls", server: LDAPServer{Mode: LDAPModeLDAPS, StartTLS: true}, want: LDAPModeLDAPS},
+		{name: "Plain", server: LDAPServer{Mode: LDAPModePlain}, want: LDAPModePlain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.server.connMode(); got != tt.want {
+				t.Errorf("LDAPServer.connMode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuoLDAPSyncConfig_validate(t *testing.T) {
+	valid := func() DuoLDAPSyncConfig {
+		return DuoLDAPSyncConfig{
+			LDAPServers:    []*LDAPServer{{Address: "ldap1.example.com", Port: 636, Mode: LDAPModeLDAPS}},
+			LDAPUserSearch: &LDAPUserSearch{BaseDN: "dc=example,dc=com", UserFilter: "objectClass=posixAccount", UserAttr: "uid"},
+			DuoAPI:         &DuoAPI{Ikey: "DIXXXXXXXXXXXXXXXXXX", Skey: "secret", APIHost: "api-XXXXXXXX.duosecurity.com"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *DuoLDAPSyncConfig)
+		wantErr bool
+	}{
+		{name: "Valid", modify: func(c *DuoLDAPSyncConfig) {}},
+		{name: "No servers", modify: func(c *DuoLDAPSyncConfig) { c.LDAPServers = nil }, wantErr: true},
+		{name: "Server without address", modify: func(c *DuoLDAPSyncConfig) { c.LDAPServers[0].Address = "" }, wantErr: true},
+		{name: "Unknown mode", modify: func(c *DuoLDAPSyncConfig) { c.LDAPServers[0].Mode = "ssl" }, wantErr: true},
+		{name: "Bind DN with password", modify: func(c *DuoLDAPSyncConfig) {
+			c.LDAPServers[0].BindDN, c.LDAPServers[0].BindPassword = "cn=sync,dc=example,dc=com", "secret"
+		}},
+		{name: "Bind DN without password", modify: func(c *DuoLDAPSyncConfig) { c.LDAPServers[0].BindDN = "cn=sync,dc=example,dc=com" }, wantErr: true},
+		{name: "Unknown TLS version", modify: func(c *DuoLDAPSyncConfig) { c.LDAPServers[0].MinTLSVersion = "2" }, wantErr: true},
+		{name: "Missing user_search", modify: func(c *DuoLDAPSyncConfig) { c.LDAPUserSearch = nil }, wantErr: true},
+		{name: "Missing user_attr", modify: func(c *DuoLDAPSyncConfig) { c.LDAPUserSearch.UserAttr = "" }, wantErr: true},
+		{name: "Missing duo_api", modify: func(c *DuoLDAPSyncConfig) { c.DuoAPI = nil }, wantErr: true},
+		{name: "Missing skey", modify: func(c *DuoLDAPSyncConfig) { c.DuoAPI.Skey = "" }, wantErr: true},
+		{name: "Grace period", modify: func(c *DuoLDAPSyncConfig) { c.DuoAPI.DeprovisionGrace = "72h" }},
+		{name: "Invalid grace period", modify: func(c *DuoLDAPSyncConfig) { c.DuoAPI.DeprovisionGrace = "3 days" }, wantErr: true},
+		{name: "Negative grace cycles", modify: func(c *DuoLDAPSyncConfig) { c.DuoAPI.DeprovisionGraceCycles = -1 }, wantErr: true},
+		{name: "Invalid protected regexp", modify: func(c *DuoLDAPSyncConfig) { c.DuoAPI.Protected = &ProtectedUsers{Regexps: []string{"("}} }, wantErr: true},
+		{name: "Negative enroll reminders", modify: func(c *DuoLDAPSyncConfig) { c.DuoAPI.MaxEnrollReminders = -1 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(&c)
+			if err := c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("DuoLDAPSyncConfig.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLDAPGroupSearch_membership(t *testing.T) {
+	tests := []struct {
+		name           string
+		search         LDAPGroupSearch
+		wantMembership string
+		wantMemberAttr string
+	}{
+		{name: "Default", search: LDAPGroupSearch{}, wantMembership: MembershipMemberOf, wantMemberAttr: ""},
+		{name: "memberUid attribute", search: LDAPGroupSearch{MemberAttr: "memberUid"}, wantMembership: MembershipMemberUID, wantMemberAttr: "memberUid"},
+		{name: "uniqueMember attribute", search: LDAPGroupSearch{MemberAttr: "uniqueMember"}, wantMembership: MembershipMember, wantMemberAttr: "uniqueMember"},
+		{name: "member model", search: LDAPGroupSearch{Membership: MembershipMember}, wantMembership: MembershipMember, wantMemberAttr: "member"},
+		{name: "memberuid model", search: LDAPGroupSearch{Membership: MembershipMemberUID}, wantMembership: MembershipMemberUID, wantMemberAttr: "memberUid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.search.membership(); got != tt.wantMembership {
+				t.Errorf("LDAPGroupSearch.membership() = %v, want %v", got, tt.wantMembership)
+			}
+			if got := tt.search.memberAttr(); got != tt.wantMemberAttr {
+				t.Errorf("LDAPGroupSearch.memberAttr() = %v, want %v", got, tt.wantMemberAttr)
+			}
+		})
+	}
+}
+
+func TestDuoLDAPSyncConfig_stateRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		search LDAPUserSearch
+		duo    DuoAPI
+		want   bool
+	}{
+		{name: "Nothing relies on state", duo: DuoAPI{Deprovision: DeprovisionDelete}, want: false},
+		{name: "Grace period", duo: DuoAPI{Deprovision: DeprovisionDelete, DeprovisionGraceCycles: 2}, want: true},
+		{name: "Enrollment emails", duo: DuoAPI{SendEnrollEmail: true}, want: true},
+		{name: "Deprovision disable", duo: DuoAPI{Deprovision: DeprovisionDisable}, want: true},
+		{name: "Disabled accounts detected", search: LDAPUserSearch{DisabledPresets: []string{"ad"}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DuoLDAPSyncConfig{LDAPUserSearch: &tt.search, DuoAPI: &tt.duo}
+			if got := c.stateRequired(); got != tt.want {
+				t.Errorf("DuoLDAPSyncConfig.stateRequired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pageSize(t *testing.T) {
+	tests := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{name: "User search default", got: (&LDAPUserSearch{}).pageSize(), want: defaultPageSize},
+		{name: "User search configured", got: (&LDAPUserSearch{PageSize: 100}).pageSize(), want: 100},
+		{name: "Group search default", got: (&LDAPGroupSearch{}).pageSize(), want: defaultPageSize},
+		{name: "Group search configured", got: (&LDAPGroupSearch{PageSize: 100}).pageSize(), want: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("pageSize() = %d, want %d", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuoAPI_deprovision(t *testing.T) {
+	tests := []struct {
+		name string
+		conf DuoAPI
+		want string
+	}{
+		{name: "Default", conf: DuoAPI{}, want: DeprovisionNone},
+		{name: "Legacy delete_users", conf: DuoAPI{DeleteUsers: true}, want: DeprovisionDelete},
+		{name: "Deprovision overrides delete_users", conf: DuoAPI{DeleteUsers: true, Deprovision: DeprovisionDisable}, want: DeprovisionDisable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conf.deprovision(); got != tt.want {
+				t.Errorf("DuoAPI.deprovision() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
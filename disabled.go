@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// adAccountDisable is the ACCOUNTDISABLE flag of the Active Directory userAccountControl attribute
+const adAccountDisable = 0x2
+
+// disabledPreset detects disabled accounts using attributes of a specific directory server.
+type disabledPreset struct {
+	attrs      []string
+	isDisabled func(entry *ldap.Entry, now time.Time) bool
+}
+
+// disabledPresets are the built in disabled account detections, selected with LDAPUserSearch.DisabledPresets
+var disabledPresets = map[string]disabledPreset{
+	// Active Directory userAccountControl with the ACCOUNTDISABLE flag set
+	"ad": {
+		attrs: []string{"userAccountControl"},
+		isDisabled: func(entry *ldap.Entry, now time.Time) bool {
+			uac, err := strconv.ParseInt(entry.GetAttributeValue("userAccountControl"), 10, 64)
+			return err == nil && uac&adAccountDisable != 0
+		},
+	},
+	// 389 Directory Server and Red Hat IdM account lock
+	"389ds": {
+		attrs: []string{"nsAccountLock"},
+		isDisabled: func(entry *ldap.Entry, now time.Time) bool {
+			return strings.EqualFold(entry.GetAttributeValue("nsAccountLock"), "true")
+		},
+	},
+	// OpenLDAP ppolicy overlay lockout
+	"ppolicy": {
+		attrs: []string{"pwdAccountLockedTime"},
+		isDisabled: func(entry *ldap.Entry, now time.Time) bool {
+			return entry.GetAttributeValue("pwdAccountLockedTime") != ""
+		},
+	},
+	// shadowAccount expiration, in days since the epoch
+	"shadow": {
+		attrs: []string{"shadowExpire"},
+		isDisabled: func(entry *ldap.Entry, now time.Time) bool {
+			days, err := strconv.ParseInt(entry.GetAttributeValue("shadowExpire"), 10, 64)
+			if err != nil || days < 0 {
+				return false
+			}
+			return !now.Before(time.Unix(days*24*60*60, 0))
+		},
+	},
+}
+
+// detectsDisabled returns true if disabled account detection is configured.
+func (c *LDAPUserSearch) detectsDisabled() bool {
+	return len(c.DisabledPresets) > 0 || c.DisabledAttr != ""
+}
+
+// disabledAttrs returns the attributes needed to detect disabled accounts.
+func (c *LDAPUserSearch) disabledAttrs() []string {
+	var attrs []string
+	for _, name := range c.DisabledPresets {
+		attrs = append(attrs, disabledPresets[name].attrs...)
+	}
+	if c.DisabledAttr != "" {
+		attrs = append(attrs, c.DisabledAttr)
+	}
+	return attrs
+}
+
+// isDisabled returns true if entry is disabled by any of the configured presets or the custom disabled attribute.
+func (c *LDAPUserSearch) isDisabled(entry *ldap.Entry, now time.Time) bool {
+	for _, name := range c.DisabledPresets {
+		if preset, ok := disabledPresets[name]; ok && preset.isDisabled(entry, now) {
+			return true
+		}
+	}
+
+	if c.DisabledAttr != "" {
+		values := entry.GetAttributeValues(c.DisabledAttr)
+		if len(c.DisabledValues) == 0 {
+			return len(values) > 0
+		}
+		for _, value := range values {
+			for _, disabledValue := range c.DisabledValues {
+				if strings.EqualFold(value, disabledValue) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
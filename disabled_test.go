@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestLDAPUserSearch_isDisabled(t *testing.T) {
+	now := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	// Days since the epoch of now
+	today := "17928"
+
+	tests := []struct {
+		name   string
+		search LDAPUserSearch
+		attrs  map[string][]string
+		want   bool
+	}{
+		{name: "AD enabled", search: LDAPUserSearch{DisabledPresets: []string{"ad"}}, attrs: map[string][]string{"userAccountControl": {"512"}}, want: false},
+		{name: "AD disabled", search: LDAPUserSearch{DisabledPresets: []string{"ad"}}, attrs: map[string][]string{"userAccountControl": {"514"}}, want: true},
+		{name: "389ds locked", search: LDAPUserSearch{DisabledPresets: []string{"389ds"}}, attrs: map[string][]string{"nsAccountLock": {"TRUE"}}, want: true},
+		{name: "389ds unlocked", search: LDAPUserSearch{DisabledPresets: []string{"389ds"}}, attrs: map[string][]string{"nsAccountLock": {"false"}}, want: false},
+		{name: "ppolicy locked", search: LDAPUserSearch{DisabledPresets: []string{"ppolicy"}}, attrs: map[string][]string{"pwdAccountLockedTime": {"000001010000Z"}}, want: true},
+		{name: "ppolicy unlocked", search: LDAPUserSearch{DisabledPresets: []string{"ppolicy"}}, attrs: map[string][]string{}, want: false},
+		{name: "shadow expired", search: LDAPUserSearch{DisabledPresets: []string{"shadow"}}, attrs: map[string][]string{"shadowExpire": {today}}, want: true},
+		{name: "shadow not expired", search: LDAPUserSearch{DisabledPresets: []string{"shadow"}}, attrs: map[string][]string{"shadowExpire": {"17929"}}, want: false},
+		{name: "shadow never expires", search: LDAPUserSearch{DisabledPresets: []string{"shadow"}}, attrs: map[string][]string{"shadowExpire": {"-1"}}, want: false},
+		{name: "Multiple presets", search: LDAPUserSearch{DisabledPresets: []string{"ppolicy", "shadow"}}, attrs: map[string][]string{"shadowExpire": {"1"}}, want: true},
+		{name: "Custom attribute present", search: LDAPUserSearch{DisabledAttr: "loginDisabled"}, attrs: map[string][]string{"loginDisabled": {"yes"}}, want: true},
+		{name: "Custom attribute value", search: LDAPUserSearch{DisabledAttr: "employeeStatus", DisabledValues: []string{"terminated", "leave"}}, attrs: map[string][]string{"employeeStatus": {"Leave"}}, want: true},
+		{name: "Custom attribute other value", search: LDAPUserSearch{DisabledAttr: "employeeStatus", DisabledValues: []string{"terminated"}}, attrs: map[string][]string{"employeeStatus": {"active"}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := ldap.NewEntry("uid=jsmith,dc=example,dc=com", tt.attrs)
+			if got := tt.search.isDisabled(entry, now); got != tt.want {
+				t.Errorf("LDAPUserSearch.isDisabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
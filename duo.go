@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strconv"
 
 	duoapi "github.com/duosecurity/duo_api_golang"
 	"github.com/duosecurity/duo_api_golang/admin"
@@ -15,6 +16,74 @@ type PostUsersResult struct {
 	Response admin.User
 }
 
+// duoUsersPageSize is the number of users requested per page from GET /admin/v1/users, the maximum
+// allowed by the Duo Admin API.
+const duoUsersPageSize = 300
+
+// DuoUser is a user returned by the GET /admin/v1/users endpoint, including the is_enrolled flag admin.User lacks
+type DuoUser struct {
+	admin.User
+	IsEnrolled bool `json:"is_enrolled"`
+}
+
+// GetUsersResult represents the response from the GET /admin/v1/users endpoint
+type GetUsersResult struct {
+	duoapi.StatResult
+	Metadata admin.ListResultMetadata `json:"metadata"`
+	Response []DuoUser
+}
+
+// GetAllUsers retrieves all Duo users a page at a time and verifies the number of users collected
+// matches the total_objects metadata returned by the Duo Admin API, so a short listing is an error
+// rather than a partial result.
+// See https://duo.com/docs/adminapi#retrieve-users
+func GetAllUsers(client *admin.Client) (*GetUsersResult, error) {
+	result := &GetUsersResult{}
+	var offset uint64
+
+	for {
+		params := url.Values{}
+		params.Set("limit", strconv.Itoa(duoUsersPageSize))
+		params.Set("offset", strconv.FormatUint(offset, 10))
+		_, body, err := client.SignedCall("GET", "/admin/v1/users", params, duoapi.UseTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		page := &GetUsersResult{}
+		if err = json.Unmarshal(body, page); err != nil {
+			return nil, err
+		} else if page.Stat != "OK" {
+			return nil, fmt.Errorf("Duo API returned non-ok status at offset %d with message: %v", offset, page.Message)
+		}
+
+		result.StatResult = page.StatResult
+		result.Metadata = page.Metadata
+		result.Response = append(result.Response, page.Response...)
+
+		next := page.Metadata.NextOffset.String()
+		if next == "" {
+			break
+		}
+		nextOffset, err := strconv.ParseUint(next, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Duo API returned invalid next_offset %q: %v", next, err)
+		} else if nextOffset <= offset {
+			return nil, fmt.Errorf("Duo API returned next_offset %d that does not advance past offset %d", nextOffset, offset)
+		}
+		offset = nextOffset
+	}
+
+	total, err := result.Metadata.TotalObjects.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("Duo API returned invalid total_objects %q: %v", result.Metadata.TotalObjects, err)
+	} else if total != int64(len(result.Response)) {
+		return nil, fmt.Errorf("Duo API reported %d total users but %d were retrieved", total, len(result.Response))
+	}
+
+	return result, nil
+}
+
 // CreateUser creates a new Duo user via the Duo Admin Client
 // See https://duo.com/docs/adminapi#create-user
 func CreateUser(client *admin.Client, params url.Values, dryRun bool) (*PostUsersResult, error) {
@@ -34,6 +103,26 @@ func CreateUser(client *admin.Client, params url.Values, dryRun bool) (*PostUser
 	return &PostUsersResult{duoapi.StatResult{Stat: "OK"}, admin.User{}}, nil
 }
 
+// UpdateUser updates the attributes in params of the Duo user with ID userID via the Duo Admin Client
+// See https://duo.com/docs/adminapi#modify-user
+func UpdateUser(client *admin.Client, userID string, params url.Values, dryRun bool) (*PostUsersResult, error) {
+	if !dryRun {
+		path := fmt.Sprintf("/admin/v1/users/%s", userID)
+		_, body, err := client.SignedCall("POST", path, params, duoapi.UseTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := &PostUsersResult{}
+		if err = json.Unmarshal(body, ret); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	return &PostUsersResult{duoapi.StatResult{Stat: "OK"}, admin.User{}}, nil
+}
+
 // DeleteUser deletes a Duo user via the Duo Admin Client
 // See https://duo.com/docs/adminapi#delete-user
 func DeleteUser(client *admin.Client, userID string, dryRun bool) (*duoapi.StatResult, error) {
@@ -71,3 +160,119 @@ func EnrollUser(client *admin.Client, params url.Values, dryRun bool) (*duoapi.S
 	}
 	return &duoapi.StatResult{Stat: "OK"}, nil
 }
+
+// PostGroupsResult represents the response from the POST /admin/v1/groups endpoint
+type PostGroupsResult struct {
+	duoapi.StatResult
+	Response admin.Group
+}
+
+// GetAllGroups retrieves all Duo groups via the Duo Admin Client
+// See https://duo.com/docs/adminapi#retrieve-groups
+func GetAllGroups(client *admin.Client) (*admin.GetGroupsResult, error) {
+	result, err := client.GetGroups()
+	if err != nil {
+		return nil, err
+	} else if result.Stat != "OK" {
+		return nil, fmt.Errorf("Duo API returned non-ok status with message: %v", result.Message)
+	}
+	return result, nil
+}
+
+// CreateGroup creates a new Duo group via the Duo Admin Client
+// See https://duo.com/docs/adminapi#create-group
+func CreateGroup(client *admin.Client, params url.Values, dryRun bool) (*PostGroupsResult, error) {
+	if !dryRun {
+		_, body, err := client.SignedCall("POST", "/admin/v1/groups", params, duoapi.UseTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := &PostGroupsResult{}
+		if err = json.Unmarshal(body, ret); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	return &PostGroupsResult{duoapi.StatResult{Stat: "OK"}, admin.Group{}}, nil
+}
+
+// UpdateGroup updates the attributes in params of the Duo group with ID groupID via the Duo Admin Client
+// See https://duo.com/docs/adminapi#update-group
+func UpdateGroup(client *admin.Client, groupID string, params url.Values, dryRun bool) (*PostGroupsResult, error) {
+	if !dryRun {
+		path := fmt.Sprintf("/admin/v1/groups/%s", groupID)
+		_, body, err := client.SignedCall("POST", path, params, duoapi.UseTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := &PostGroupsResult{}
+		if err = json.Unmarshal(body, ret); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	return &PostGroupsResult{duoapi.StatResult{Stat: "OK"}, admin.Group{}}, nil
+}
+
+// DeleteGroup deletes a Duo group via the Duo Admin Client
+// See https://duo.com/docs/adminapi#delete-group
+func DeleteGroup(client *admin.Client, groupID string, dryRun bool) (*duoapi.StatResult, error) {
+	if !dryRun {
+		path := fmt.Sprintf("/admin/v1/groups/%s", groupID)
+		_, body, err := client.SignedCall("DELETE", path, nil, duoapi.UseTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := &duoapi.StatResult{}
+		if err = json.Unmarshal(body, ret); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	return &duoapi.StatResult{Stat: "OK"}, nil
+}
+
+// AddUserGroup adds the Duo user with ID userID to the group with ID groupID via the Duo Admin Client
+// See https://duo.com/docs/adminapi#associate-group-with-user
+func AddUserGroup(client *admin.Client, userID string, groupID string, dryRun bool) (*duoapi.StatResult, error) {
+	if !dryRun {
+		path := fmt.Sprintf("/admin/v1/users/%s/groups", userID)
+		params := url.Values{}
+		params.Set("group_id", groupID)
+		_, body, err := client.SignedCall("POST", path, params, duoapi.UseTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := &duoapi.StatResult{}
+		if err = json.Unmarshal(body, ret); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	return &duoapi.StatResult{Stat: "OK"}, nil
+}
+
+// RemoveUserGroup removes the Duo user with ID userID from the group with ID groupID via the Duo Admin Client
+// See https://duo.com/docs/adminapi#disassociate-group-from-user
+func RemoveUserGroup(client *admin.Client, userID string, groupID string, dryRun bool) (*duoapi.StatResult, error) {
+	if !dryRun {
+		path := fmt.Sprintf("/admin/v1/users/%s/groups/%s", userID, groupID)
+		_, body, err := client.SignedCall("DELETE", path, nil, duoapi.UseTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := &duoapi.StatResult{}
+		if err = json.Unmarshal(body, ret); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	return &duoapi.StatResult{Stat: "OK"}, nil
+}
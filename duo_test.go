@@ -127,6 +127,63 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+func TestUpdateUser(t *testing.T) {
+	const updateUserResponse = `{
+		"stat": "OK",
+		"response": {
+			"email": "jsmith@example.org",
+			"firstname": "Joe",
+			"lastname": "Smith",
+			"realname": "Joe Smith",
+			"status": "active",
+			"user_id": "DU3RP9I2WOC59VZX672N",
+			"username": "jsmith"
+		}
+	}`
+
+	var gotPath string
+	var gotEmail string
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.Path
+			if err := r.ParseForm(); err == nil {
+				gotEmail = r.PostForm.Get("email")
+			}
+			fmt.Fprintln(w, updateUserResponse)
+		}),
+	)
+	defer ts.Close()
+
+	duo := buildAdminClient(ts.URL, nil)
+	params := url.Values{"email": []string{"jsmith@example.org"}}
+
+	got, err := UpdateUser(duo, "DU3RP9I2WOC59VZX672N", params, false)
+	if err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if got.Stat != "OK" || got.Response.Email != "jsmith@example.org" {
+		t.Errorf("UpdateUser() = %#v", got)
+	}
+	if gotPath != "/admin/v1/users/DU3RP9I2WOC59VZX672N" {
+		t.Errorf("UpdateUser() requested path %s", gotPath)
+	}
+	if gotEmail != "jsmith@example.org" {
+		t.Errorf("UpdateUser() sent email %q", gotEmail)
+	}
+
+	gotPath = ""
+	got, err = UpdateUser(duo, "DU3RP9I2WOC59VZX672N", params, true)
+	if err != nil {
+		t.Fatalf("UpdateUser() dryRun error = %v", err)
+	}
+	if !reflect.DeepEqual(got, &PostUsersResult{duoapi.StatResult{Stat: "OK"}, admin.User{}}) {
+		t.Errorf("UpdateUser() dryRun = %#v", got)
+	}
+	if gotPath != "" {
+		t.Errorf("UpdateUser() dryRun made a request to %s", gotPath)
+	}
+}
+
 func TestDeleteUser(t *testing.T) {
 	deleteUserResponse := `{
 		"stat": "OK",
@@ -245,3 +302,156 @@ func TestEnrollUser(t *testing.T) {
 		})
 	}
 }
+
+func TestGetAllUsers(t *testing.T) {
+	// pages maps the requested offset to the users and next_offset returned
+	type page struct {
+		users      []string
+		nextOffset string
+	}
+
+	handler := func(pages map[string]page, total int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			p, ok := pages[r.URL.Query().Get("offset")]
+			if !ok {
+				fmt.Fprintln(w, `{"stat": "FAIL", "code": 40002, "message": "Invalid request parameters"}`)
+				return
+			}
+			users := make([]string, 0, len(p.users))
+			for _, u := range p.users {
+				users = append(users, fmt.Sprintf(`{"username": "%s", "user_id": "ID%s", "is_enrolled": %t}`, u, u, u == "jsmith"))
+			}
+			nextOffset := "null"
+			if p.nextOffset != "" {
+				nextOffset = p.nextOffset
+			}
+			fmt.Fprintf(w, `{"stat": "OK", "metadata": {"next_offset": %s, "total_objects": %d}, "response": [%s]}`,
+				nextOffset, total, strings.Join(users, ","))
+		}
+	}
+
+	tests := []struct {
+		name    string
+		pages   map[string]page
+		total   int
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "Single page",
+			pages: map[string]page{"0": {users: []string{"jsmith", "jdoe"}}},
+			total: 2,
+			want:  []string{"jsmith", "jdoe"},
+		},
+		{
+			name: "Multiple pages",
+			pages: map[string]page{
+				"0": {users: []string{"jsmith", "jdoe"}, nextOffset: "2"},
+				"2": {users: []string{"asmith"}},
+			},
+			total: 3,
+			want:  []string{"jsmith", "jdoe", "asmith"},
+		},
+		{
+			name:    "Short listing",
+			pages:   map[string]page{"0": {users: []string{"jsmith"}}},
+			total:   2,
+			wantErr: true,
+		},
+		{
+			name:    "Failed page",
+			pages:   map[string]page{"0": {users: []string{"jsmith"}, nextOffset: "1"}},
+			total:   2,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewTLSServer(handler(tt.pages, tt.total))
+			defer ts.Close()
+
+			got, err := GetAllUsers(buildAdminClient(ts.URL, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetAllUsers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var usernames []string
+			for _, u := range got.Response {
+				usernames = append(usernames, u.Username)
+				if u.UserID != "ID"+u.Username || u.IsEnrolled != (u.Username == "jsmith") {
+					t.Errorf("GetAllUsers() user %s UserID = %s, IsEnrolled = %v", u.Username, u.UserID, u.IsEnrolled)
+				}
+			}
+			if !reflect.DeepEqual(usernames, tt.want) {
+				t.Errorf("GetAllUsers() = %v, want %v", usernames, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateGroup(t *testing.T) {
+	const createGroupResponse = `{
+		"stat": "OK",
+		"response": {
+			"desc": "Administrators [duoldapsync]",
+			"group_id": "DGXXXXXXXXXXXXXXXXXX",
+			"name": "admins",
+			"push_enabled": true,
+			"sms_enabled": true,
+			"status": "active",
+			"voice_enabled": true,
+			"mobile_otp_enabled": true
+		}
+	}`
+
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, createGroupResponse)
+		}),
+	)
+	defer ts.Close()
+
+	duo := buildAdminClient(ts.URL, nil)
+	params := url.Values{"name": []string{"admins"}, "desc": []string{"Administrators [duoldapsync]"}}
+
+	tests := []struct {
+		name   string
+		dryRun bool
+		want   *PostGroupsResult
+	}{
+		{
+			name: "Create group",
+			want: &PostGroupsResult{
+				duoapi.StatResult{Stat: "OK"},
+				admin.Group{
+					MobileOTPEnabled: true,
+					PushEnabled:      true,
+					SMSEnabled:       true,
+					VoiceEnabled:     true,
+					Desc:             "Administrators [duoldapsync]",
+					GroupID:          "DGXXXXXXXXXXXXXXXXXX",
+					Name:             "admins",
+					Status:           "active",
+				},
+			},
+		},
+		{
+			name:   "Create group dryRun",
+			dryRun: true,
+			want:   &PostGroupsResult{duoapi.StatResult{Stat: "OK"}, admin.Group{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CreateGroup(duo, params, tt.dryRun)
+			if err != nil {
+				t.Fatalf("CreateGroup() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CreateGroup() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/duosecurity/duo_api_golang/admin"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// managedGroupMarker is appended to the description of Duo groups created by duoldapsync. Only Duo groups
+// carrying the marker are updated or deleted, so groups created by other means are left alone.
+const managedGroupMarker = "[duoldapsync]"
+
+// Group represents the attributes of a group found in LDAP and records if the group has been found in Duo.
+type Group struct {
+	Name       string
+	DN         string
+	Desc       string
+	DuoGroupID string
+	DuoDesc    string   // Description of the group as it is currently set in Duo
+	Members    []string // Values of the LDAP member attribute, DNs or usernames depending on the membership model
+	Groups     []string // Values of the LDAP group membership attribute of the group itself, for nested groups
+
+	LDAP        bool // Group found in LDAP
+	Duo         bool // Group found in Duo
+	Managed     bool // Duo group was created by duoldapsync
+	NeedsUpdate bool // Indicates the LDAP description is different than what is in Duo, and the Duo group needs to be updated.
+}
+
+// duoDesc returns the description to set in Duo for the group, the LDAP description followed by managedGroupMarker.
+func (g *Group) duoDesc() string {
+	if g.Desc == "" {
+		return managedGroupMarker
+	}
+	return g.Desc + " " + managedGroupMarker
+}
+
+// DuoCreate creates a group with the description desc, eg. from duoDesc, via the Duo Admin API
+func (g *Group) duoCreate(client *admin.Client, desc string, dryRun bool) error {
+	params := url.Values{}
+	params.Set("name", g.Name)
+	params.Set("desc", desc)
+
+	result, err := CreateGroup(client, params, dryRun)
+	if err != nil {
+		return fmt.Errorf("CreateGroup failed: %s when attempting to create group: %s", err, g.Name)
+	} else if result.Stat != "OK" {
+		return fmt.Errorf("CreateGroup Duo API returned non-ok status when attemping to create group: %s with message: %v", g.Name, result.Message)
+	}
+
+	g.DuoGroupID = result.Response.GroupID
+	g.DuoDesc = params.Get("desc")
+	return nil
+}
+
+// DuoUpdate updates the description of a group to desc via the Duo Admin API
+func (g *Group) duoUpdate(client *admin.Client, desc string, dryRun bool) error {
+	params := url.Values{}
+	params.Set("desc", desc)
+
+	result, err := UpdateGroup(client, g.DuoGroupID, params, dryRun)
+	if err != nil {
+		return fmt.Errorf("UpdateGroup failed: %s when attempting to update group: %s", err, g.Name)
+	} else if result.Stat != "OK" {
+		return fmt.Errorf("UpdateGroup Duo API returned non-ok status when attemping to update group: %s with message: %v", g.Name, result.Message)
+	}
+	return nil
+}
+
+// DuoDelete deletes a group via the Duo Admin API
+func (g *Group) duoDelete(client *admin.Client, dryRun bool) error {
+	result, err := DeleteGroup(client, g.DuoGroupID, dryRun)
+	if err != nil {
+		return fmt.Errorf("DeleteGroup failed: %s when attempting to delete group: %s", err, g.Name)
+	} else if result.Stat != "OK" {
+		return fmt.Errorf("DeleteGroup Duo API returned non-ok status when attemping to delete group: %s with message: %v", g.Name, result.Message)
+	}
+	return nil
+}
+
+// GroupSet is a map of Groups indexed by group name
+type GroupSet map[string]*Group
+
+// AddLDAPEntries iterates through the results of an LDAP search, adding found groups to the GroupSet. membershipAttr
+// is the attribute listing the groups a group is a member of, if any.
+func (g GroupSet) addLDAPEntries(entries []*ldap.Entry, ldapGroupSearch *LDAPGroupSearch, membershipAttr string) {
+	for _, entry := range entries {
+		name := entry.GetAttributeValue(ldapGroupSearch.GroupAttr)
+		if name == "" {
+			log.Printf("Warning: Found DN %s but group attribute %s is an empty string", entry.DN, ldapGroupSearch.GroupAttr)
+			continue
+		}
+
+		if _, ok := g[name]; ok {
+			g[name].LDAP = true
+		} else {
+			g[name] = &Group{LDAP: true}
+		}
+
+		g[name].Name = name
+		g[name].DN = entry.DN
+		g[name].Desc = entry.GetAttributeValue(ldapGroupSearch.descAttr())
+		if memberAttr := ldapGroupSearch.memberAttr(); memberAttr != "" {
+			g[name].Members = entry.GetAttributeValues(memberAttr)
+		}
+		if membershipAttr != "" {
+			g[name].Groups = entry.GetAttributeValues(membershipAttr)
+		}
+	}
+}
+
+// AddDuoResults iterates over a GroupsResult from the Duo Admin API and marks the Duo attribute in a Group in the
+// GroupSet to show that the group already exist in Duo.
+func (g GroupSet) addDuoResults(result *admin.GetGroupsResult) {
+	for _, dGroup := range result.Response {
+		if _, ok := g[dGroup.Name]; ok {
+			g[dGroup.Name].Duo = true
+		} else {
+			g[dGroup.Name] = &Group{Duo: true, Name: dGroup.Name}
+		}
+
+		g[dGroup.Name].DuoGroupID = dGroup.GroupID
+		g[dGroup.Name].DuoDesc = dGroup.Desc
+		g[dGroup.Name].Managed = strings.HasSuffix(dGroup.Desc, managedGroupMarker)
+	}
+}
+
+// MarkUpdates sets NeedsUpdate on managed groups found in both LDAP and Duo whose description differs from LDAP.
+func (g GroupSet) markUpdates() {
+	for _, group := range g {
+		group.NeedsUpdate = group.LDAP && group.Duo && group.Managed && group.DuoDesc != group.duoDesc()
+	}
+}
+
+// Lookup finds a group by DN, compared case insensitively, or by name.
+func (g GroupSet) lookup(dnOrName string) *Group {
+	if group, ok := g[dnOrName]; ok {
+		return group
+	}
+	for _, group := range g {
+		if group.DN != "" && strings.EqualFold(group.DN, dnOrName) {
+			return group
+		}
+	}
+	return nil
+}
+
+// ResolveNames finds the LDAP groups given by DN or name. An error is returned if any group can't be found.
+func (g GroupSet) resolveNames(dnOrNames []string) ([]*Group, error) {
+	groups := make([]*Group, 0, len(dnOrNames))
+	for _, dnOrName := range dnOrNames {
+		group := g.lookup(dnOrName)
+		if group == nil || !group.LDAP {
+			return nil, fmt.Errorf("LDAP group %s not found", dnOrName)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// ResolveMembers records the names of the LDAP groups each LDAP user is a member of in User.MemberOf, according
+// to the membership model:
+//   - memberof: the user's group membership attribute lists group DNs, or group names
+//   - member: each group's member attribute lists user DNs, as with member or uniqueMember
+//   - memberuid: each group's member attribute lists usernames, as with posixGroup memberUid
+func (g GroupSet) resolveMembers(users UserSet, membership string) {
+	usersByDN := map[string]*User{}
+	for _, user := range users {
+		if !user.LDAP {
+			continue
+		}
+		user.MemberOf = map[string]bool{}
+		if user.DN != "" {
+			usersByDN[strings.ToLower(user.DN)] = user
+		}
+	}
+
+	switch membership {
+	case MembershipMemberOf:
+		groupsByDN := map[string]*Group{}
+		for _, group := range g {
+			if group.LDAP && group.DN != "" {
+				groupsByDN[strings.ToLower(group.DN)] = group
+			}
+		}
+		for _, user := range users {
+			if !user.LDAP {
+				continue
+			}
+			for _, value := range user.Groups {
+				if group, ok := groupsByDN[strings.ToLower(value)]; ok {
+					user.MemberOf[group.Name] = true
+				} else if group, ok := g[value]; ok && group.LDAP {
+					user.MemberOf[group.Name] = true
+				}
+			}
+		}
+	case MembershipMember:
+		for _, group := range g {
+			if !group.LDAP {
+				continue
+			}
+			for _, member := range group.Members {
+				if user, ok := usersByDN[strings.ToLower(memberDN(member))]; ok {
+					user.MemberOf[group.Name] = true
+				}
+			}
+		}
+	case MembershipMemberUID:
+		for _, group := range g {
+			if !group.LDAP {
+				continue
+			}
+			for _, member := range group.Members {
+				if user, ok := users[member]; ok && user.LDAP {
+					user.MemberOf[group.Name] = true
+				}
+			}
+		}
+	}
+}
+
+// memberDN strips the optional unique identifier from a uniqueMember value, eg. uid=jsmith,dc=example,dc=com#'0101'B
+func memberDN(member string) string {
+	if i := strings.LastIndex(member, "#'"); i != -1 && strings.HasSuffix(member, "'B") {
+		return member[:i]
+	}
+	return member
+}
+
+// ResolveNested adds the groups each LDAP user is a member of through nested groups to User.MemberOf, walking up
+// from the groups found by resolveMembers. A group is nested in another group if it is listed in that group's members
+// by DN, or if it lists that group in its own group membership attribute. Cycles in the group graph are ignored.
+func (g GroupSet) resolveNested(users UserSet) {
+	groupsByDN := map[string]*Group{}
+	for _, group := range g {
+		if group.LDAP && group.DN != "" {
+			groupsByDN[strings.ToLower(group.DN)] = group
+		}
+	}
+
+	// parents maps a group name to the names of the groups it is directly a member of
+	parents := map[string][]string{}
+	for _, group := range g {
+		if !group.LDAP {
+			continue
+		}
+		for _, member := range group.Members {
+			if child, ok := groupsByDN[strings.ToLower(member)]; ok {
+				parents[child.Name] = append(parents[child.Name], group.Name)
+			}
+		}
+		for _, value := range group.Groups {
+			if parent, ok := groupsByDN[strings.ToLower(value)]; ok {
+				parents[group.Name] = append(parents[group.Name], parent.Name)
+			} else if parent, ok := g[value]; ok && parent.LDAP {
+				parents[group.Name] = append(parents[group.Name], parent.Name)
+			}
+		}
+	}
+
+	for _, user := range users {
+		if !user.LDAP {
+			continue
+		}
+		stack := make([]string, 0, len(user.MemberOf))
+		for name := range user.MemberOf {
+			stack = append(stack, name)
+		}
+		for len(stack) > 0 {
+			name := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, parent := range parents[name] {
+				if !user.MemberOf[parent] {
+					user.MemberOf[parent] = true
+					stack = append(stack, parent)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/duosecurity/duo_api_golang/admin"
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestGroupSet_addLDAPEntries(t *testing.T) {
+	search := &LDAPGroupSearch{GroupAttr: "cn"}
+
+	g := GroupSet{"admins": &Group{Duo: true, Name: "admins", DuoGroupID: "DG1"}}
+	g.addLDAPEntries([]*ldap.Entry{
+		ldap.NewEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}, "description": {"Administrators"}}),
+		ldap.NewEntry("cn=users,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"users"}}),
+		ldap.NewEntry("cn=noname,ou=groups,dc=example,dc=com", map[string][]string{}),
+	}, search, "")
+
+	wants := GroupSet{
+		"admins": &Group{LDAP: true, Duo: true, Name: "admins", DN: "cn=admins,ou=groups,dc=example,dc=com", Desc: "Administrators", DuoGroupID: "DG1"},
+		"users":  &Group{LDAP: true, Name: "users", DN: "cn=users,ou=groups,dc=example,dc=com"},
+	}
+	if !reflect.DeepEqual(g, wants) {
+		t.Fatalf("Mismatch between result %v and wants %v", g, wants)
+	}
+}
+
+func TestGroupSet_addDuoResults(t *testing.T) {
+	g := GroupSet{"admins": &Group{LDAP: true, Name: "admins", Desc: "Administrators"}}
+	g.addDuoResults(&admin.GetGroupsResult{
+		Response: []admin.Group{
+			{Name: "admins", GroupID: "DG1", Desc: "Old " + managedGroupMarker},
+			{Name: "manual", GroupID: "DG2", Desc: "Created by hand"},
+		},
+	})
+
+	wants := GroupSet{
+		"admins": &Group{LDAP: true, Duo: true, Managed: true, Name: "admins", Desc: "Administrators", DuoGroupID: "DG1", DuoDesc: "Old " + managedGroupMarker},
+		"manual": &Group{Duo: true, Name: "manual", DuoGroupID: "DG2", DuoDesc: "Created by hand"},
+	}
+	if !reflect.DeepEqual(g, wants) {
+		t.Fatalf("Mismatch between result %v and wants %v", g, wants)
+	}
+}
+
+func TestGroupSet_markUpdates(t *testing.T) {
+	g := GroupSet{
+		"changed":   &Group{LDAP: true, Duo: true, Managed: true, Name: "changed", Desc: "New", DuoDesc: "Old " + managedGroupMarker},
+		"unchanged": &Group{LDAP: true, Duo: true, Managed: true, Name: "unchanged", Desc: "Same", DuoDesc: "Same " + managedGroupMarker},
+		"unmanaged": &Group{LDAP: true, Duo: true, Name: "unmanaged", Desc: "New", DuoDesc: "Old"},
+		"ldapOnly":  &Group{LDAP: true, Name: "ldapOnly", Desc: "New"},
+	}
+	g.markUpdates()
+
+	wants := map[string]bool{"changed": true, "unchanged": false, "unmanaged": false, "ldapOnly": false}
+	for name, want := range wants {
+		if g[name].NeedsUpdate != want {
+			t.Errorf("GroupSet.markUpdates() %s NeedsUpdate = %v, want %v", name, g[name].NeedsUpdate, want)
+		}
+	}
+}
+
+func TestGroupSet_resolveMembers(t *testing.T) {
+	newUserSet := func() UserSet {
+		return UserSet{
+			"jsmith": &User{LDAP: true, Username: "jsmith", DN: "uid=jsmith,ou=people,dc=example,dc=com", Groups: []string{"cn=Admins,ou=groups,dc=example,dc=com", "duo"}},
+			"jdoe":   &User{LDAP: true, Username: "jdoe", DN: "uid=jdoe,ou=people,dc=example,dc=com"},
+			"duo":    &User{Duo: true, Username: "duo"},
+		}
+	}
+	g := GroupSet{
+		"admins": &Group{LDAP: true, Name: "admins", DN: "cn=admins,ou=groups,dc=example,dc=com"},
+		"staff":  &Group{LDAP: true, Name: "staff", DN: "cn=staff,ou=groups,dc=example,dc=com", Members: []string{"UID=jdoe,ou=people,dc=example,dc=com", "uid=jsmith,ou=people,dc=example,dc=com#'0101'B"}},
+		"posix":  &Group{LDAP: true, Name: "posix", DN: "cn=posix,ou=groups,dc=example,dc=com", Members: []string{"jsmith", "nobody"}},
+		"duo":    &Group{Duo: true, Name: "duo"},
+	}
+
+	tests := []struct {
+		name       string
+		membership string
+		wants      map[string]map[string]bool
+	}{
+		{
+			name:       "memberof",
+			membership: MembershipMemberOf,
+			wants:      map[string]map[string]bool{"jsmith": {"admins": true}, "jdoe": {}, "duo": nil},
+		},
+		{
+			name:       "member",
+			membership: MembershipMember,
+			wants:      map[string]map[string]bool{"jsmith": {"staff": true}, "jdoe": {"staff": true}, "duo": nil},
+		},
+		{
+			name:       "memberuid",
+			membership: MembershipMemberUID,
+			wants:      map[string]map[string]bool{"jsmith": {"posix": true}, "jdoe": {}, "duo": nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newUserSet()
+			g.resolveMembers(u, tt.membership)
+			for name, want := range tt.wants {
+				if !reflect.DeepEqual(u[name].MemberOf, want) {
+					t.Errorf("GroupSet.resolveMembers() %s MemberOf = %v, want %v", name, u[name].MemberOf, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupSet_resolveNames(t *testing.T) {
+	g := GroupSet{
+		"duo-users": &Group{LDAP: true, Name: "duo-users", DN: "cn=duo-users,ou=groups,dc=example,dc=com"},
+		"duo-only":  &Group{Duo: true, Name: "duo-only"},
+	}
+
+	got, err := g.resolveNames([]string{"duo-users", "CN=duo-users,ou=groups,dc=example,dc=com"})
+	if err != nil {
+		t.Fatalf("GroupSet.resolveNames() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, []*Group{g["duo-users"], g["duo-users"]}) {
+		t.Errorf("GroupSet.resolveNames() = %v", got)
+	}
+
+	if _, err := g.resolveNames([]string{"missing"}); err == nil {
+		t.Errorf("GroupSet.resolveNames() expected error for missing group")
+	}
+	if _, err := g.resolveNames([]string{"duo-only"}); err == nil {
+		t.Errorf("GroupSet.resolveNames() expected error for group not in LDAP")
+	}
+}
+
+func TestGroupSet_resolveNested(t *testing.T) {
+	g := GroupSet{
+		// all-staff contains engineering by member DN, engineering contains platform by memberOf on platform
+		"all-staff":   &Group{LDAP: true, Name: "all-staff", DN: "cn=all-staff,dc=example,dc=com", Members: []string{"cn=Engineering,dc=example,dc=com"}},
+		"engineering": &Group{LDAP: true, Name: "engineering", DN: "cn=engineering,dc=example,dc=com"},
+		"platform":    &Group{LDAP: true, Name: "platform", DN: "cn=platform,dc=example,dc=com", Groups: []string{"cn=engineering,dc=example,dc=com"}},
+		// cycle-a and cycle-b are members of each other
+		"cycle-a": &Group{LDAP: true, Name: "cycle-a", DN: "cn=cycle-a,dc=example,dc=com", Members: []string{"cn=cycle-b,dc=example,dc=com"}},
+		"cycle-b": &Group{LDAP: true, Name: "cycle-b", DN: "cn=cycle-b,dc=example,dc=com", Members: []string{"cn=cycle-a,dc=example,dc=com"}},
+	}
+	u := UserSet{
+		"jsmith": &User{LDAP: true, Username: "jsmith", MemberOf: map[string]bool{"platform": true}},
+		"jdoe":   &User{LDAP: true, Username: "jdoe", MemberOf: map[string]bool{"cycle-a": true}},
+		"asmith": &User{LDAP: true, Username: "asmith", MemberOf: map[string]bool{}},
+	}
+	g.resolveNested(u)
+
+	wants := map[string]map[string]bool{
+		"jsmith": {"platform": true, "engineering": true, "all-staff": true},
+		"jdoe":   {"cycle-a": true, "cycle-b": true},
+		"asmith": {},
+	}
+	for name, want := range wants {
+		if !reflect.DeepEqual(u[name].MemberOf, want) {
+			t.Errorf("GroupSet.resolveNested() %s MemberOf = %v, want %v", name, u[name].MemberOf, want)
+		}
+	}
+}
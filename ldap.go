@@ -2,58 +2,239 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"path/filepath"
 	"strings"
 
 	ldap "gopkg.in/ldap.v2"
 )
 
 func connect(servers []*LDAPServer) (*ldap.Conn, error) {
-	l := &ldap.Conn{}
 	var connErrs []string
 
 	for _, server := range servers {
-		l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", server.Address, server.Port))
+		addr := fmt.Sprintf("%s:%d", server.Address, server.Port)
+
+		var l *ldap.Conn
+		var err error
+		switch server.connMode() {
+		case LDAPModePlain:
+			l, err = ldap.Dial("tcp", addr)
+		case LDAPModeStartTLS:
+			l, err = dialStartTLS(addr, server)
+		case LDAPModeLDAPS:
+			l, err = dialLDAPS(addr, server)
+		default:
+			err = fmt.Errorf("unknown mode %q for LDAP server %s", server.Mode, server.Address)
+		}
 		if err != nil {
 			connErrs = append(connErrs, err.Error())
 			continue
 		}
 
-		// Reconnect with TLS
-		// TODO: verify based on CA
-		if server.StartTLS {
-			err := l.StartTLS(&tls.Config{InsecureSkipVerify: true})
+		// Bind with a read only user, otherwise searches are performed anonymously
+		if server.BindDN != "" {
+			if server.BindPassword == "" {
+				connErrs = append(connErrs, fmt.Sprintf("refusing unauthenticated bind as %s to %s:%d, bind_password is empty", server.BindDN, server.Address, server.Port))
+				l.Close()
+				continue
+			}
+			err := l.Bind(server.BindDN, server.BindPassword)
 			if err != nil {
-				connErrs = append(connErrs, err.Error())
+				connErrs = append(connErrs, fmt.Sprintf("bind as %s to %s:%d failed: %v", server.BindDN, server.Address, server.Port, err))
+				l.Close()
 				continue
 			}
 		}
 
-		// First bind with a read only user
-		//err = l.Bind(bindusername, bindpassword)
-		//if err != nil {
-		//	log.Fatal(err)
-		//}
+		// Don't wait forever on a request to a server that has gone away
+		l.SetTimeout(ldap.DefaultTimeout)
 
 		if debug {
-			log.Printf("LDAP connection successful: %v\n", *server)
+			log.Printf("LDAP connection successful: %s:%d\n", server.Address, server.Port)
 		}
 
 		return l, nil
 	}
 
-	return l, errors.New(strings.Join(connErrs, "\n"))
+	return nil, errors.New(strings.Join(connErrs, "\n"))
+}
+
+// ldapConn holds the connection to one of the configured LDAP servers and reconnects through
+// the server list when the connection has been lost.
+type ldapConn struct {
+	servers []*LDAPServer
+	conn    *ldap.Conn
+}
+
+// newLDAPConn connects to the first available server in servers.
+func newLDAPConn(servers []*LDAPServer) (*ldapConn, error) {
+	c := &ldapConn{servers: servers}
+	if _, err := c.get(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// get returns a working LDAP connection. The existing connection is checked with a search of
+// the root DSE, and if that fails a new connection is made via connect.
+func (c *ldapConn) get() (*ldap.Conn, error) {
+	if c.conn != nil {
+		err := ping(c.conn)
+		if err == nil {
+			return c.conn, nil
+		}
+		log.Printf("LDAP connection lost, reconnecting: %v", err)
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	l, err := connect(c.servers)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = l
+
+	return c.conn, nil
+}
+
+// close closes the current LDAP connection if there is one.
+func (c *ldapConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// ping checks that l is still usable by reading the root DSE without requesting any attributes.
+func ping(l *ldap.Conn) error {
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	)
+
+	_, err := l.Search(searchRequest)
+	return err
+}
+
+// dialLDAPS connects to addr with implicit TLS, typically on port 636.
+func dialLDAPS(addr string, server *LDAPServer) (*ldap.Conn, error) {
+	tlsConf, err := tlsConfig(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return ldap.DialTLS("tcp", addr, tlsConf)
+}
+
+// dialStartTLS connects to addr in plain text and then upgrades the connection with StartTLS.
+func dialStartTLS(addr string, server *LDAPServer) (*ldap.Conn, error) {
+	tlsConf, err := tlsConfig(server)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := ldap.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.StartTLS(tlsConf); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig builds the TLS configuration used to connect to server. The server certificate
+// is verified against CAFile and CADir if set, otherwise against the system CA pool.
+func tlsConfig(server *LDAPServer) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         server.Address,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: server.InsecureSkipVerify,
+	}
+
+	if server.ServerName != "" {
+		conf.ServerName = server.ServerName
+	}
+
+	if server.MinTLSVersion != "" {
+		version, ok := tlsVersions[server.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_tls_version %q for LDAP server %s", server.MinTLSVersion, server.Address)
+		}
+		conf.MinVersion = version
+	}
+
+	if server.InsecureSkipVerify {
+		log.Printf("WARNING certificate verification is disabled for LDAP server %s", server.Address)
+	}
+
+	if server.CAFile == "" && server.CADir == "" {
+		return conf, nil
+	}
+
+	var caFiles []string
+	if server.CAFile != "" {
+		caFiles = append(caFiles, server.CAFile)
+	}
+	if server.CADir != "" {
+		files, err := ioutil.ReadDir(server.CADir)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_dir for LDAP server %s failed: %v", server.Address, err)
+		}
+		for _, file := range files {
+			if file.Mode().IsRegular() {
+				caFiles = append(caFiles, filepath.Join(server.CADir, file.Name()))
+			}
+		}
+	}
+
+	pool := x509.NewCertPool()
+	found := false
+	for _, caFile := range caFiles {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA for LDAP server %s failed: %v", server.Address, err)
+		}
+		if pool.AppendCertsFromPEM(pem) {
+			found = true
+		} else if caFile == server.CAFile {
+			return nil, fmt.Errorf("no PEM certificates found in ca_file %s for LDAP server %s", caFile, server.Address)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no PEM certificates found in ca_dir %s for LDAP server %s", server.CADir, server.Address)
+	}
+	conf.RootCAs = pool
+
+	return conf, nil
 }
 
-// enumUsers enumerates all users from LDAP
+// enumUsers enumerates all users from LDAP. The RFC 2696 paged results control is used so
+// servers that limit the number of entries per search, like Active Directory, return all users.
 func enumUsers(l *ldap.Conn, c *LDAPUserSearch) (*ldap.SearchResult, error) {
 	searchRequest := ldap.NewSearchRequest(
 		c.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		fmt.Sprintf("(%s)", c.UserFilter),
-		[]string{c.UserAttr, c.GroupMembershipAttr, c.EmailAttr, c.FullNameAttr, c.FirstNameAttr, c.LastNameAttr},
+		append([]string{c.UserAttr, c.GroupMembershipAttr, c.EmailAttr, c.FullNameAttr, c.FirstNameAttr, c.LastNameAttr}, c.disabledAttrs()...),
 		nil,
 	)
 
@@ -61,17 +242,17 @@ func enumUsers(l *ldap.Conn, c *LDAPUserSearch) (*ldap.SearchResult, error) {
 		log.Printf("LDAP executing search: %v\n", searchRequest)
 	}
 
-	return l.Search(searchRequest)
+	return l.SearchWithPaging(searchRequest, c.pageSize())
 }
 
-/*
-func groupSearch(group string, l *ldap.Conn, c *LDAPGroupSearch) (*ldap.SearchResult, error) {
-	// Search for the given group
+// enumGroups enumerates all groups from LDAP. membershipAttr is requested so groups that are members of other
+// groups can be found when resolving nested groups.
+func enumGroups(l *ldap.Conn, c *LDAPGroupSearch, membershipAttr string) (*ldap.SearchResult, error) {
 	searchRequest := ldap.NewSearchRequest(
 		c.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(&(%s)(%s=%s))", c.GroupFilter, c.GroupAttr, group),
-		[]string{"dn"},
+		fmt.Sprintf("(%s)", c.GroupFilter),
+		[]string{c.GroupAttr, c.descAttr(), c.memberAttr(), membershipAttr},
 		nil,
 	)
 
@@ -79,17 +260,53 @@ func groupSearch(group string, l *ldap.Conn, c *LDAPGroupSearch) (*ldap.SearchRe
 		log.Printf("LDAP executing search: %v\n", searchRequest)
 	}
 
-	return l.Search(searchRequest)
+	return l.SearchWithPaging(searchRequest, c.pageSize())
+}
+
+// OIDs used to resolve nested group membership in Active Directory
+const (
+	oidActiveDirectory = "1.2.840.113556.1.4.800"  // LDAP_CAP_ACTIVE_DIRECTORY_OID
+	oidMatchingInChain = "1.2.840.113556.1.4.1941" // LDAP_MATCHING_RULE_IN_CHAIN
+)
+
+// supportsInChain reports if the server supports LDAP_MATCHING_RULE_IN_CHAIN, which is true of Active Directory.
+func supportsInChain(l *ldap.Conn) (bool, error) {
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"supportedCapabilities"},
+		nil,
+	)
+
+	sr, err := l.Search(searchRequest)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range sr.Entries {
+		for _, capability := range entry.GetAttributeValues("supportedCapabilities") {
+			if capability == oidActiveDirectory {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
 }
 
-// enumGroups enumerates all groups from LDAP
-func enumGroups(l *ldap.Conn, c *LDAPGroupSearch) (*ldap.SearchResult, error) {
-	// Search for the given group
+// enumGroupMembersInChain enumerates the users that are members of the group with DN groupDN, directly or through
+// nested groups, using LDAP_MATCHING_RULE_IN_CHAIN.
+func enumGroupMembersInChain(l *ldap.Conn, c *LDAPUserSearch, groupDN string) (*ldap.SearchResult, error) {
+	membershipAttr := c.GroupMembershipAttr
+	if membershipAttr == "" {
+		membershipAttr = "memberOf"
+	}
+
 	searchRequest := ldap.NewSearchRequest(
 		c.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(%s)", c.GroupFilter),
-		[]string{"dn"},
+		fmt.Sprintf("(&(%s)(%s:%s:=%s))", c.UserFilter, membershipAttr, oidMatchingInChain, ldap.EscapeFilter(groupDN)),
+		[]string{c.UserAttr},
 		nil,
 	)
 
@@ -97,6 +314,5 @@ func enumGroups(l *ldap.Conn, c *LDAPGroupSearch) (*ldap.SearchResult, error) {
 		log.Printf("LDAP executing search: %v\n", searchRequest)
 	}
 
-	return l.Search(searchRequest)
+	return l.SearchWithPaging(searchRequest, c.pageSize())
 }
-*/
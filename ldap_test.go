@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func writeTestCA(t *testing.T, dir string) string {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	path := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("writing test CA failed: %s", err)
+	}
+	return path
+}
+
+func Test_tlsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duoldapsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := writeTestCA(t, dir)
+
+	notPEM := filepath.Join(dir, "notpem.txt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		server         *LDAPServer
+		wantServerName string
+		wantMinVersion uint16
+		wantRootCAs    bool
+		wantErr        bool
+	}{
+		{
+			name:           "Defaults",
+			server:         &LDAPServer{Address: "ldap1.example.com"},
+			wantServerName: "ldap1.example.com",
+			wantMinVersion: tls.VersionTLS12,
+		},
+		{
+			name:           "Server name and min version",
+			server:         &LDAPServer{Address: "10.0.0.1", ServerName: "ldap1.example.com", MinTLSVersion: "1.3"},
+			wantServerName: "ldap1.example.com",
+			wantMinVersion: tls.VersionTLS13,
+		},
+		{
+			name:    "Unknown min version",
+			server:  &LDAPServer{Address: "ldap1.example.com", MinTLSVersion: "1.4"},
+			wantErr: true,
+		},
+		{
+			name:           "CA file",
+			server:         &LDAPServer{Address: "ldap1.example.com", CAFile: caFile},
+			wantServerName: "ldap1.example.com",
+			wantMinVersion: tls.VersionTLS12,
+			wantRootCAs:    true,
+		},
+		{
+			name:           "CA dir",
+			server:         &LDAPServer{Address: "ldap1.example.com", CADir: dir},
+			wantServerName: "ldap1.example.com",
+			wantMinVersion: tls.VersionTLS12,
+			wantRootCAs:    true,
+		},
+		{
+			name:    "CA file without certificates",
+			server:  &LDAPServer{Address: "ldap1.example.com", CAFile: notPEM},
+			wantErr: true,
+		},
+		{
+			name:    "Missing CA file",
+			server:  &LDAPServer{Address: "ldap1.example.com", CAFile: filepath.Join(dir, "missing.pem")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tlsConfig(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tlsConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.ServerName != tt.wantServerName {
+				t.Errorf("tlsConfig() ServerName = %s, want %s", got.ServerName, tt.wantServerName)
+			}
+			if got.MinVersion != tt.wantMinVersion {
+				t.Errorf("tlsConfig() MinVersion = %x, want %x", got.MinVersion, tt.wantMinVersion)
+			}
+			if (got.RootCAs != nil) != tt.wantRootCAs {
+				t.Errorf("tlsConfig() RootCAs = %v, wantRootCAs %v", got.RootCAs, tt.wantRootCAs)
+			}
+			if got.InsecureSkipVerify {
+				t.Errorf("tlsConfig() InsecureSkipVerify should default to false")
+			}
+		})
+	}
+}
+
+// closedLDAPConn returns an *ldap.Conn that has already been closed, like a connection the server has dropped.
+func closedLDAPConn() *ldap.Conn {
+	client, server := net.Pipe()
+	server.Close()
+	l := ldap.NewConn(client, false)
+	l.Start()
+	l.Close()
+	return l
+}
+
+func TestLdapConn_get(t *testing.T) {
+	// A listener that accepts connections is enough for connect in plain mode without a bind
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	reachable := []*LDAPServer{{Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := []*LDAPServer{{Address: "127.0.0.1", Port: closed.Addr().(*net.TCPAddr).Port}}
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		conn    *ldap.Conn
+		servers []*LDAPServer
+		wantErr bool
+	}{
+		{name: "No connection", conn: nil, servers: reachable},
+		{name: "Dead connection reconnects", conn: closedLDAPConn(), servers: reachable},
+		{name: "Dead connection without reachable servers", conn: closedLDAPConn(), servers: unreachable, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ldapConn{servers: tt.servers, conn: tt.conn}
+			defer c.close()
+
+			got, err := c.get()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ldapConn.get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if got != nil || c.conn != nil {
+					t.Errorf("ldapConn.get() kept a connection after failing to reconnect")
+				}
+				return
+			}
+			if got == nil || got == tt.conn || c.conn != got {
+				t.Errorf("ldapConn.get() = %p, want a new connection replacing %p", got, tt.conn)
+			}
+		})
+	}
+}
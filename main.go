@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 
@@ -11,18 +12,38 @@ import (
 var configPath string
 var debug bool
 var dryRun bool
+var once bool
 var pollTime int
+var shutdownTimeout int
+var summary bool
 var profileOut string
 
 func init() {
 	pflag.StringVarP(&configPath, "config", "f", "config.json", "Path to configuration file")
 	pflag.BoolVarP(&debug, "debug", "d", false, "Enable debug output")
 	pflag.BoolVarP(&dryRun, "dryrun", "n", false, "Dry-run mode, don't actually create or delete users in Duo")
+	pflag.BoolVarP(&once, "once", "o", false, "Run a single sync cycle and exit with 0 if there were no changes, 2 if changes were made, or 1 if errors occurred")
 	pflag.IntVarP(&pollTime, "poll", "p", 600, "Number of seconds to wait between polling LDAP and Duo for changes")
+	pflag.BoolVarP(&summary, "summary", "s", false, "Print a summary of the changes made at the end of each sync cycle, always printed in dry-run mode")
+	pflag.IntVar(&shutdownTimeout, "shutdown-timeout", 60, "Number of seconds to wait for the current sync cycle to finish when stopping")
 	pflag.StringVarP(&profileOut, "profile", "P", "", "Enable cpu, mem, or block profiling")
+
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [plan PLANFILE | apply PLANFILE | adopt]\n\n", os.Args[0])
+		fmt.Fprint(os.Stderr, "Without a command, sync continuously or once with --once. plan writes the changes a sync would make to\n")
+		fmt.Fprint(os.Stderr, "PLANFILE for review, and apply makes exactly those changes if LDAP and Duo haven't changed since.\n")
+		fmt.Fprint(os.Stderr, "adopt marks existing Duo users found in LDAP as owned by duoldapsync.\n\n")
+		pflag.PrintDefaults()
+	}
 }
 
 func main() {
+	os.Exit(realMain())
+}
+
+// realMain runs duoldapsync and returns its exit code, so deferred calls like stopping the profiler run before main
+// exits.
+func realMain() int {
 	pflag.Parse()
 
 	if profileOut != "" {
@@ -38,14 +59,52 @@ func main() {
 		}
 	}
 
+	command := pflag.Arg(0)
+	switch command {
+	case "":
+	case "plan", "apply":
+		if pflag.NArg() != 2 {
+			pflag.Usage()
+			return exitErrors
+		}
+	case "adopt":
+		if pflag.NArg() != 1 {
+			pflag.Usage()
+			return exitErrors
+		}
+	default:
+		log.Printf("Unknown command %q\n", command)
+		pflag.Usage()
+		return exitErrors
+	}
+
 	conf, err := loadConfig(configPath)
 	if err != nil {
 		log.Printf("loadConfig error: %v\n", err)
-		os.Exit(1)
+		return exitErrors
+	}
+
+	var result syncResult
+	switch {
+	case command == "plan":
+		result, err = runPlan(conf, pflag.Arg(1))
+	case command == "apply":
+		result, err = runApply(conf, pflag.Arg(1), dryRun)
+	case command == "adopt":
+		result, err = runAdopt(conf, dryRun)
+	case once:
+		result, err = runOnce(conf, dryRun)
+	default:
+		if err := run(conf, dryRun); err != nil {
+			log.Printf("Run error: %v\n", err)
+			return exitErrors
+		}
+		return 0
 	}
 
-	if err := run(conf, dryRun); err != nil {
+	if err != nil {
 		log.Printf("Run error: %v\n", err)
-		os.Exit(1)
+		return exitErrors
 	}
+	return result.exitCode()
 }
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/duosecurity/duo_api_golang/admin"
+)
+
+// Plan is the set of changes to make in Duo, decided from the UserSet and GroupSet of a sync cycle before any change
+// is made. The plan command writes a Plan to a file for review, and the apply command executes it.
+type Plan struct {
+	Created     time.Time `json:"created"`
+	Fingerprint string    `json:"fingerprint"` // Hash of the settings and data the plan was decided from, see fingerprint
+
+	CreateGroups []PlanGroup      `json:"create_groups,omitempty"`
+	UpdateGroups []PlanGroup      `json:"update_groups,omitempty"`
+	DeleteGroups []PlanGroup      `json:"delete_groups,omitempty"`
+	CreateUsers  []PlanUser       `json:"create_users,omitempty"`
+	UpdateUsers  []PlanUser       `json:"update_users,omitempty"`
+	EnrollUsers  []PlanUser       `json:"enroll_users,omitempty"`
+	DisableUsers []PlanUser       `json:"disable_users,omitempty"`
+	DeleteUsers  []PlanUser       `json:"delete_users,omitempty"`
+	GroupChanges []PlanMembership `json:"group_changes,omitempty"`
+}
+
+// PlanUser is a Duo user to create, update, enroll, disable or delete.
+type PlanUser struct {
+	Username string                `json:"username"`
+	UserID   string                `json:"user_id,omitempty"`
+	Changes  map[string]PlanChange `json:"changes,omitempty"` // Attributes set in Duo, indexed by Duo API parameter
+}
+
+// values returns the new values of the attributes planned for the user, as Duo Admin API parameters.
+func (p PlanUser) values() url.Values {
+	params := url.Values{}
+	for param, change := range p.Changes {
+		params.Set(param, change.New)
+	}
+	return params
+}
+
+// PlanGroup is a Duo group to create, update or delete.
+type PlanGroup struct {
+	Name    string      `json:"name"`
+	GroupID string      `json:"group_id,omitempty"`
+	Desc    *PlanChange `json:"desc,omitempty"`
+}
+
+// desc returns the planned description of the group.
+func (p PlanGroup) desc() string {
+	if p.Desc == nil {
+		return ""
+	}
+	return p.Desc.New
+}
+
+// PlanChange is the current and new value of a Duo attribute.
+type PlanChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// PlanMembership is the Duo groups a user is to be added to and removed from, by name.
+type PlanMembership struct {
+	Username string   `json:"username"`
+	Add      []string `json:"add,omitempty"`
+	Remove   []string `json:"remove,omitempty"`
+}
+
+// changes returns the number of changes in the plan.
+func (p *Plan) changes() int {
+	n := len(p.CreateGroups) + len(p.UpdateGroups) + len(p.DeleteGroups) + len(p.CreateUsers) + len(p.UpdateUsers) +
+		len(p.EnrollUsers) + len(p.DisableUsers) + len(p.DeleteUsers)
+	for _, m := range p.GroupChanges {
+		n += len(m.Add) + len(m.Remove)
+	}
+	return n
+}
+
+// dropEnrollments removes the enrollments from the plan. Without state to record the emails sent, every unenrolled
+// user would be emailed again each cycle.
+func (p *Plan) dropEnrollments() {
+	if len(p.EnrollUsers) > 0 {
+		log.Print("WARNING no enrollment emails will be sent without state to record them")
+	}
+	p.EnrollUsers = nil
+}
+
+// fingerprint returns a hash of the duo_api settings and of the users and groups gathered from LDAP and Duo, used to
+// detect if any of them has changed between making a plan and applying it.
+func fingerprint(conf *DuoAPI, userSet UserSet, groupSet GroupSet) string {
+	data, err := json.Marshal(struct {
+		Settings DuoAPI
+		Users    UserSet
+		Groups   GroupSet
+	}{conf.planSettings(), userSet, groupSet})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// userChanges returns the attributes that creating or updating the user sets in Duo, along with their current values.
+// marker is the ownership marker set in the notes of created users.
+func userChanges(u *User, create bool, marker string) map[string]PlanChange {
+	changes := map[string]PlanChange{}
+	if create {
+		params, err := u.createValues(marker)
+		if err != nil {
+			return changes
+		}
+		params.Del("username")
+		for param := range params {
+			changes[param] = PlanChange{New: params.Get(param)}
+		}
+		return changes
+	}
+
+	current := map[string]string{
+		"realname":  u.DuoFullName,
+		"email":     u.DuoEmail,
+		"firstname": u.DuoFirstName,
+		"lastname":  u.DuoLastName,
+		"status":    u.DuoStatus,
+	}
+	params := u.updateValues()
+	for param := range params {
+		changes[param] = PlanChange{Old: current[param], New: params.Get(param)}
+	}
+	return changes
+}
+
+// buildPlan decides the changes to make in Duo for the users in userSet and the groups in groupSet, which is nil
+// unless groups are synced. Refused changes, like deprovisioning more users than MaxDeleteUsers allows, are counted
+// as errors in the returned syncResult.
+func buildPlan(conf DuoLDAPSyncConfig, userSet UserSet, groupSet GroupSet, state *State, deprovision string, now time.Time) (*Plan, syncResult) {
+	result := syncResult{}
+	plan := &Plan{Created: now, Fingerprint: fingerprint(conf.DuoAPI, userSet, groupSet)}
+
+	groupNames := make([]string, 0, len(groupSet))
+	ldapGroupCount := 0
+	for name, group := range groupSet {
+		groupNames = append(groupNames, name)
+		if group.LDAP {
+			ldapGroupCount++
+		}
+	}
+	sort.Strings(groupNames)
+
+	// Avoid deleting all managed Duo groups accidently
+	deleteGroups := ldapGroupCount > 0
+	if groupSet != nil && !deleteGroups {
+		log.Print("WARNING no LDAP groups found, no Duo groups will be deleted")
+	}
+
+	for _, name := range groupNames {
+		group := groupSet[name]
+		if group.LDAP && !group.Duo {
+			plan.CreateGroups = append(plan.CreateGroups, PlanGroup{Name: name, Desc: &PlanChange{New: group.duoDesc()}})
+			// Groups created by duoldapsync are managed, so their members are synced along with the group
+			group.Managed = true
+		} else if group.LDAP && group.Duo && !group.Managed {
+			if debug {
+				log.Printf("Duo group %s exists but was not created by duoldapsync, skipping", name)
+			}
+		} else if group.NeedsUpdate {
+			plan.UpdateGroups = append(plan.UpdateGroups, PlanGroup{
+				Name: name, GroupID: group.DuoGroupID, Desc: &PlanChange{Old: group.DuoDesc, New: group.duoDesc()},
+			})
+		} else if !group.LDAP && group.Managed && deleteGroups {
+			plan.DeleteGroups = append(plan.DeleteGroups, PlanGroup{Name: name, GroupID: group.DuoGroupID})
+		}
+	}
+
+	usernames := make([]string, 0, len(userSet))
+	for name := range userSet {
+		usernames = append(usernames, name)
+	}
+	sort.Strings(usernames)
+
+	// MaxDeleteUsers needs to be 1 or greater to make sense. Set Deprovision to none
+	// to disable user deprovisioning instead of trying to set MaxDeleteUsers to 0.
+	maxDeleteUsers := 1
+	if conf.DuoAPI.MaxDeleteUsers > 0 {
+		maxDeleteUsers = conf.DuoAPI.MaxDeleteUsers
+	}
+	usersDeprovision := []PlanUser{}
+
+	for _, name := range usernames {
+		user := userSet[name]
+		if !user.Duo {
+			plan.CreateUsers = append(plan.CreateUsers, PlanUser{Username: name, Changes: userChanges(user, true, conf.DuoAPI.ownershipMarker())})
+		} else if !conf.DuoAPI.manages(user) {
+			if debug && (user.NeedsUpdate || !user.LDAP) {
+				log.Printf("Duo user %s is protected or not owned by duoldapsync, skipping", name)
+			}
+		} else if user.NeedsUpdate {
+			plan.UpdateUsers = append(plan.UpdateUsers, PlanUser{Username: name, UserID: user.DuoUserID, Changes: userChanges(user, false, conf.DuoAPI.ownershipMarker())})
+		} else if !user.LDAP && deprovision != DeprovisionNone {
+			// Users already disabled don't need to be disabled again
+			if deprovision == DeprovisionDisable && user.DuoStatus == duoStatusDisabled {
+				continue
+			}
+			if conf.DuoAPI.hasGrace() && !state.graceElapsed(name, conf.DuoAPI, now) {
+				if debug {
+					log.Printf("Duo user %s missing from LDAP, waiting for the deprovision grace period", name)
+				}
+				continue
+			}
+			usersDeprovision = append(usersDeprovision, PlanUser{Username: name, UserID: user.DuoUserID})
+		}
+	}
+
+	// Drop all deprovisioning if there are more users than MaxDeleteUsers allows
+	if len(usersDeprovision) > maxDeleteUsers {
+		log.Printf("WARNING more users to %s than the configured DuoAPI.MaxDeleteUsers setting of %d allows, no users will be deprovisioned", deprovision, maxDeleteUsers)
+		result.Errors++
+	} else if deprovision == DeprovisionDisable && len(usersDeprovision) > 0 {
+		plan.DisableUsers = usersDeprovision
+	} else if deprovision == DeprovisionDelete && len(usersDeprovision) > 0 {
+		plan.DeleteUsers = usersDeprovision
+	}
+
+	// Enroll users in LDAP that exist in Duo or are to be created, separately from creation so a failed enrollment is
+	// retried next cycle
+	if conf.DuoAPI.SendEnrollEmail {
+		for _, name := range usernames {
+			user := userSet[name]
+			if user.LDAP && conf.DuoAPI.manages(user) && user.enrollable() && state.enrollDue(name, conf.DuoAPI, now) {
+				plan.EnrollUsers = append(plan.EnrollUsers, PlanUser{Username: name, UserID: user.DuoUserID})
+			}
+		}
+	}
+
+	// Sync group membership of users in LDAP that exist in Duo or are to be created
+	if groupSet != nil {
+		for _, name := range usernames {
+			user := userSet[name]
+			if !user.LDAP || !conf.DuoAPI.manages(user) {
+				continue
+			}
+			add, remove := user.groupChanges(groupSet)
+			if len(add) == 0 && len(remove) == 0 {
+				continue
+			}
+			membership := PlanMembership{Username: name}
+			for _, group := range add {
+				membership.Add = append(membership.Add, group.Name)
+			}
+			for _, group := range remove {
+				membership.Remove = append(membership.Remove, group.Name)
+			}
+			plan.GroupChanges = append(plan.GroupChanges, membership)
+		}
+	}
+
+	return plan, result
+}
+
+// resolveUsers looks up the users of a plan in the UserSet.
+func (u UserSet) resolveUsers(planned []PlanUser) ([]*User, error) {
+	users := make([]*User, 0, len(planned))
+	for _, p := range planned {
+		user, ok := u[p.Username]
+		if !ok {
+			return nil, fmt.Errorf("plan user %s not found", p.Username)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// resolveGroups looks up the groups of a plan in the GroupSet.
+func (g GroupSet) resolveGroups(planned []PlanGroup) ([]*Group, error) {
+	names := make([]string, 0, len(planned))
+	for _, p := range planned {
+		names = append(names, p.Name)
+	}
+	return g.resolveGroupNames(names)
+}
+
+// resolveGroupNames looks up groups of a plan by name in the GroupSet.
+func (g GroupSet) resolveGroupNames(names []string) ([]*Group, error) {
+	groups := make([]*Group, 0, len(names))
+	for _, name := range names {
+		group, ok := g[name]
+		if !ok {
+			return nil, fmt.Errorf("plan group %s not found", name)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// resolvedPlan holds the users and groups of a Plan looked up in the UserSet and GroupSet it was decided from.
+type resolvedPlan struct {
+	createGroups, updateGroups, deleteGroups                         []*Group
+	createUsers, updateUsers, enrollUsers, disableUsers, deleteUsers []*User
+}
+
+// resolvePlan looks up the users and groups of plan in userSet and groupSet.
+func resolvePlan(plan *Plan, userSet UserSet, groupSet GroupSet) (*resolvedPlan, error) {
+	r := &resolvedPlan{}
+	var err error
+	if r.createGroups, err = groupSet.resolveGroups(plan.CreateGroups); err != nil {
+		return nil, err
+	}
+	if r.updateGroups, err = groupSet.resolveGroups(plan.UpdateGroups); err != nil {
+		return nil, err
+	}
+	if r.deleteGroups, err = groupSet.resolveGroups(plan.DeleteGroups); err != nil {
+		return nil, err
+	}
+	if r.createUsers, err = userSet.resolveUsers(plan.CreateUsers); err != nil {
+		return nil, err
+	}
+	if r.updateUsers, err = userSet.resolveUsers(plan.UpdateUsers); err != nil {
+		return nil, err
+	}
+	if r.enrollUsers, err = userSet.resolveUsers(plan.EnrollUsers); err != nil {
+		return nil, err
+	}
+	if r.disableUsers, err = userSet.resolveUsers(plan.DisableUsers); err != nil {
+		return nil, err
+	}
+	if r.deleteUsers, err = userSet.resolveUsers(plan.DeleteUsers); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// applyPlan makes the changes in plan in Duo. The users and groups of the plan are looked up in userSet and groupSet,
+// which must be the ones the plan was decided from, and the users created, updated and enrolled are recorded in state.
+func applyPlan(plan *Plan, userSet UserSet, groupSet GroupSet, state *State, conf *DuoAPI, client *admin.Client, now time.Time, dryRun bool) syncResult {
+	result := syncResult{}
+
+	r, err := resolvePlan(plan, userSet, groupSet)
+	if err != nil {
+		log.Printf("Applying plan failed, %v", err)
+		result.Errors++
+		return result
+	}
+
+	// Groups and users that were planned to be created but weren't, kept apart since they often share names
+	groupsNotCreated := map[string]bool{}
+	usersNotCreated := map[string]bool{}
+
+	// Groups and users are created and updated with the attributes recorded in the plan, so a reviewed plan is applied
+	// as it reads
+	for i, group := range r.createGroups {
+		if debug {
+			log.Printf("Creating Duo group: %s", group.Name)
+		}
+		if err := group.duoCreate(client, plan.CreateGroups[i].desc(), dryRun); err != nil {
+			log.Printf("Duo Group Creation Failed, %s", err)
+			result.Errors++
+			groupsNotCreated[group.Name] = true
+			continue
+		}
+		group.Duo = true
+		result.Changes++
+	}
+
+	for i, group := range r.updateGroups {
+		if plan.UpdateGroups[i].Desc == nil {
+			continue
+		}
+		if debug {
+			log.Printf("Updating Duo group: %s", group.Name)
+		}
+		if err := group.duoUpdate(client, plan.UpdateGroups[i].desc(), dryRun); err != nil {
+			log.Printf("Duo Group Update Failed, %s", err)
+			result.Errors++
+			continue
+		}
+		result.Changes++
+	}
+
+	for _, group := range r.deleteGroups {
+		if debug {
+			log.Printf("Deleting Duo group: %s", group.Name)
+		}
+		if err := group.duoDelete(client, dryRun); err != nil {
+			log.Printf("Duo Group Delete Fail, %s", err)
+			result.Errors++
+			continue
+		}
+		result.Changes++
+	}
+
+	for i, user := range r.createUsers {
+		if debug {
+			log.Printf("Creating Duo user: %s", user.Username)
+		}
+		if err := user.duoCreate(client, plan.CreateUsers[i].values(), conf.ownershipMarker(), dryRun); err != nil {
+			log.Printf("Duo User Creation Failed, %s", err)
+			result.Errors++
+			for _, skipped := range r.createUsers[i:] {
+				usersNotCreated[skipped.Username] = true
+			}
+			break
+		}
+		result.Changes++
+		state.applied(user)
+	}
+
+	for i, user := range r.updateUsers {
+		params := plan.UpdateUsers[i].values()
+		if len(params) == 0 {
+			continue
+		}
+		if debug {
+			log.Printf("Updating Duo user: %s %v", user.Username, params)
+		}
+		if err := user.duoUpdate(client, params, dryRun); err != nil {
+			log.Printf("Duo User Update Failed, %s", err)
+			result.Errors++
+			continue
+		}
+		result.Changes++
+		state.applied(user)
+	}
+
+	usersEnroll := []*User{}
+	for _, user := range r.enrollUsers {
+		if !usersNotCreated[user.Username] {
+			usersEnroll = append(usersEnroll, user)
+		}
+	}
+	result.add(enrollUsers(client, usersEnroll, state, conf, now, dryRun))
+
+	result.add(deprovisionUsers(client, r.disableUsers, state, DeprovisionDisable, dryRun))
+	result.add(deprovisionUsers(client, r.deleteUsers, state, DeprovisionDelete, dryRun))
+
+	for _, membership := range plan.GroupChanges {
+		user, ok := userSet[membership.Username]
+		if !ok {
+			log.Printf("Applying plan failed, plan user %s not found", membership.Username)
+			result.Errors++
+			continue
+		}
+		if usersNotCreated[user.Username] {
+			continue
+		}
+		add, err := groupSet.resolveGroupNames(membership.Add)
+		if err != nil {
+			log.Printf("Applying plan failed, %v", err)
+			result.Errors++
+			continue
+		}
+		remove, err := groupSet.resolveGroupNames(membership.Remove)
+		if err != nil {
+			log.Printf("Applying plan failed, %v", err)
+			result.Errors++
+			continue
+		}
+		createdAdd := make([]*Group, 0, len(add))
+		for _, group := range add {
+			if !groupsNotCreated[group.Name] {
+				createdAdd = append(createdAdd, group)
+			}
+		}
+		result.add(syncUserGroups(client, user, createdAdd, remove, dryRun))
+	}
+
+	return result
+}
+
+// writePlan writes plan to path as indented JSON.
+func writePlan(path string, plan *Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// readPlan reads a plan written by writePlan from path.
+func readPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("parsing plan %s failed: %v", path, err)
+	}
+	return plan, nil
+}
+
+// runPlan decides the changes a sync cycle would make and writes them to path as a Plan for review, without changing
+// anything in Duo or in the state directory.
+func runPlan(conf DuoLDAPSyncConfig, path string) (syncResult, error) {
+	l, err := newLDAPConn(conf.LDAPServers)
+	if err != nil {
+		return syncResult{}, fmt.Errorf("connection to LDAP server(s) failed: %v", err)
+	}
+	defer l.close()
+
+	now := time.Now()
+	userSet, groupSet, err := collectSets(conf, l, newDuoClient(conf.DuoAPI))
+	if err != nil {
+		return syncResult{}, err
+	}
+
+	result := syncResult{}
+	state, deprovision, stateOK := observeState(conf, userSet, now, true)
+	if !stateOK && conf.stateRequired() {
+		result.Errors++
+	}
+
+	plan, planResult := buildPlan(conf, userSet, groupSet, state, deprovision, now)
+	result.add(planResult)
+	if !stateOK {
+		plan.dropEnrollments()
+	}
+	if err := writePlan(path, plan); err != nil {
+		return result, err
+	}
+	result.Changes = plan.changes()
+	log.Printf("Plan with %d changes written to %s", plan.changes(), path)
+	if err := plan.writeSummary(os.Stdout, "Planned changes:"); err != nil {
+		log.Printf("Writing summary failed, %v", err)
+	}
+
+	return result, nil
+}
+
+// runApply makes the changes of the Plan written to path by runPlan. The plan is refused if the data gathered from
+// LDAP and Duo has changed since the plan was made.
+func runApply(conf DuoLDAPSyncConfig, path string, dryRun bool) (syncResult, error) {
+	plan, err := readPlan(path)
+	if err != nil {
+		return syncResult{}, err
+	}
+
+	l, err := newLDAPConn(conf.LDAPServers)
+	if err != nil {
+		return syncResult{}, fmt.Errorf("connection to LDAP server(s) failed: %v", err)
+	}
+	defer l.close()
+
+	now := time.Now()
+	client := newDuoClient(conf.DuoAPI)
+	userSet, groupSet, err := collectSets(conf, l, client)
+	if err != nil {
+		return syncResult{}, err
+	}
+
+	// The state marks the users duoldapsync disabled, so it's observed before comparing with the fingerprint
+	// runPlan took at the same point
+	result := syncResult{}
+	state, _, stateOK := observeState(conf, userSet, now, dryRun)
+	if !stateOK && conf.stateRequired() {
+		result.Errors++
+	}
+
+	if fingerprint(conf.DuoAPI, userSet, groupSet) != plan.Fingerprint {
+		return syncResult{}, fmt.Errorf("LDAP, Duo or the duo_api settings have changed since the plan in %s was made at %s, run plan again", path, plan.Created.Format(time.RFC3339))
+	}
+
+	if !stateOK {
+		plan.dropEnrollments()
+	}
+	result.add(applyPlan(plan, userSet, groupSet, state, conf.DuoAPI, client, now, dryRun))
+	printSummary(plan, dryRun)
+
+	if stateOK && !dryRun {
+		if err := state.save(conf.stateDir()); err != nil {
+			log.Printf("Saving state to %s failed, %v", conf.stateDir(), err)
+			result.Errors++
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testPlanSets() (UserSet, GroupSet) {
+	users := UserSet{
+		"new": {Username: "new", Email: "new@example.com", LDAP: true, MemberOf: map[string]bool{"staff": true}},
+		"changed": {
+			Username: "changed", DuoUserID: "DU2", Email: "new@example.com", DuoEmail: "old@example.com",
+			DuoGroups: []string{"admins"}, DuoEnrolled: true, MemberOf: map[string]bool{}, LDAP: true, Duo: true,
+		},
+		"same": {
+			Username: "same", DuoUserID: "DU3", Email: "same@example.com", DuoEmail: "same@example.com",
+			DuoGroups: []string{"admins"}, DuoEnrolled: true, MemberOf: map[string]bool{"admins": true}, LDAP: true, Duo: true,
+		},
+		"gone": {Username: "gone", DuoUserID: "DU4", Duo: true},
+	}
+	users.markUpdates()
+
+	groups := GroupSet{
+		"admins": {Name: "admins", DuoGroupID: "DG1", DuoDesc: managedGroupMarker, LDAP: true, Duo: true, Managed: true},
+		"staff":  {Name: "staff", Desc: "Staff", LDAP: true},
+		"old":    {Name: "old", DuoGroupID: "DG3", DuoDesc: managedGroupMarker, Duo: true, Managed: true},
+	}
+	groups.markUpdates()
+
+	return users, groups
+}
+
+func Test_buildPlan(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{Deprovision: DeprovisionDelete, SyncGroups: true, SendEnrollEmail: true}}
+
+	users, groups := testPlanSets()
+	got, result := buildPlan(conf, users, groups, newState(), DeprovisionDelete, now)
+	if result.Errors != 0 {
+		t.Errorf("buildPlan() Errors = %d, want 0", result.Errors)
+	}
+
+	users, groups = testPlanSets()
+	want := &Plan{
+		Created:      now,
+		Fingerprint:  fingerprint(conf.DuoAPI, users, groups),
+		CreateGroups: []PlanGroup{{Name: "staff", Desc: &PlanChange{New: "Staff " + managedGroupMarker}}},
+		DeleteGroups: []PlanGroup{{Name: "old", GroupID: "DG3"}},
+		CreateUsers: []PlanUser{{Username: "new", Changes: map[string]PlanChange{
+			"email":  {New: "new@example.com"},
+			"notes":  {New: managedGroupMarker},
+			"status": {New: duoStatusActive},
+		}}},
+		UpdateUsers: []PlanUser{{Username: "changed", UserID: "DU2", Changes: map[string]PlanChange{
+			"email": {Old: "old@example.com", New: "new@example.com"},
+		}}},
+		EnrollUsers: []PlanUser{{Username: "new"}},
+		DeleteUsers: []PlanUser{{Username: "gone", UserID: "DU4"}},
+		GroupChanges: []PlanMembership{
+			{Username: "changed", Remove: []string{"admins"}},
+			{Username: "new", Add: []string{"staff"}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildPlan() = %+v, want %+v", got, want)
+	}
+	if got.changes() != 8 {
+		t.Errorf("Plan.changes() = %d, want 8", got.changes())
+	}
+}
+
+func Test_buildPlanDeprovision(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	users := UserSet{
+		"gone1": {Username: "gone1", DuoUserID: "DU1", Duo: true},
+		"gone2": {Username: "gone2", DuoUserID: "DU2", Duo: true, DuoStatus: duoStatusDisabled},
+	}
+
+	tests := []struct {
+		name        string
+		conf        *DuoAPI
+		deprovision string
+		state       *State
+		wantDisable []PlanUser
+		wantDelete  []PlanUser
+		wantErrors  int
+	}{
+		{
+			name:        "Delete",
+			conf:        &DuoAPI{MaxDeleteUsers: 2},
+			deprovision: DeprovisionDelete,
+			state:       newState(),
+			wantDelete:  []PlanUser{{Username: "gone1", UserID: "DU1"}, {Username: "gone2", UserID: "DU2"}},
+		},
+		{
+			name:        "Disable skips disabled users",
+			conf:        &DuoAPI{},
+			deprovision: DeprovisionDisable,
+			state:       newState(),
+			wantDisable: []PlanUser{{Username: "gone1", UserID: "DU1"}},
+		},
+		{
+			name:        "Over MaxDeleteUsers",
+			conf:        &DuoAPI{MaxDeleteUsers: 1},
+			deprovision: DeprovisionDelete,
+			state:       newState(),
+			wantErrors:  1,
+		},
+		{
+			name:        "Grace period",
+			conf:        &DuoAPI{MaxDeleteUsers: 2, DeprovisionGraceCycles: 2},
+			deprovision: DeprovisionDelete,
+			state: &State{Users: map[string]*UserState{
+				"gone1": {FirstMissing: now, MissingCycles: 2},
+				"gone2": {FirstMissing: now, MissingCycles: 1},
+			}},
+			wantDelete: []PlanUser{{Username: "gone1", UserID: "DU1"}},
+		},
+		{
+			name:        "None",
+			conf:        &DuoAPI{},
+			deprovision: DeprovisionNone,
+			state:       newState(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, result := buildPlan(DuoLDAPSyncConfig{DuoAPI: tt.conf}, users, nil, tt.state, tt.deprovision, now)
+			if !reflect.DeepEqual(got.DisableUsers, tt.wantDisable) {
+				t.Errorf("buildPlan() DisableUsers = %v, want %v", got.DisableUsers, tt.wantDisable)
+			}
+			if !reflect.DeepEqual(got.DeleteUsers, tt.wantDelete) {
+				t.Errorf("buildPlan() DeleteUsers = %v, want %v", got.DeleteUsers, tt.wantDelete)
+			}
+			if result.Errors != tt.wantErrors {
+				t.Errorf("buildPlan() Errors = %d, want %d", result.Errors, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func Test_buildPlanFirstRun(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{SendEnrollEmail: true}}
+	users, groups := testPlanSets()
+	users["unenrolled"] = &User{Username: "unenrolled", DuoUserID: "DU5", Email: "unenrolled@example.com", LDAP: true, Duo: true}
+
+	// Existing Duo users may have been emailed before there was any state to record it
+	state := newState()
+	state.observe(users, now)
+
+	got, _ := buildPlan(conf, users, groups, state, DeprovisionNone, now)
+	want := []PlanUser{{Username: "new"}}
+	if !reflect.DeepEqual(got.EnrollUsers, want) {
+		t.Errorf("buildPlan() EnrollUsers = %v, want %v", got.EnrollUsers, want)
+	}
+}
+
+func Test_buildPlanProtected(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{
+		Deprovision: DeprovisionDelete,
+		SyncGroups:  true,
+		Protected:   &ProtectedUsers{Usernames: []string{"gone"}, Groups: []string{"admins"}},
+	}}
+	users, groups := testPlanSets()
+	if err := users.markProtected(conf.DuoAPI.Protected); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := buildPlan(conf, users, groups, newState(), DeprovisionDelete, now)
+	if len(got.UpdateUsers) != 0 || len(got.DeleteUsers) != 0 {
+		t.Errorf("buildPlan() UpdateUsers = %v, DeleteUsers = %v, want protected users left alone", got.UpdateUsers, got.DeleteUsers)
+	}
+	want := []PlanMembership{{Username: "new", Add: []string{"staff"}}}
+	if !reflect.DeepEqual(got.GroupChanges, want) {
+		t.Errorf("buildPlan() GroupChanges = %v, want %v", got.GroupChanges, want)
+	}
+	if len(got.CreateUsers) != 1 {
+		t.Errorf("buildPlan() CreateUsers = %v, want new", got.CreateUsers)
+	}
+}
+
+func Test_buildPlanOwnership(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{Deprovision: DeprovisionDelete, SyncGroups: true, Ownership: true}}
+	users, groups := testPlanSets()
+	users["changed"].DuoNotes = managedGroupMarker
+	users.markOwned(conf.DuoAPI.ownershipMarker())
+
+	got, _ := buildPlan(conf, users, groups, newState(), DeprovisionDelete, now)
+	if len(got.DeleteUsers) != 0 {
+		t.Errorf("buildPlan() DeleteUsers = %v, want unowned users left alone", got.DeleteUsers)
+	}
+	if len(got.UpdateUsers) != 1 || got.UpdateUsers[0].Username != "changed" {
+		t.Errorf("buildPlan() UpdateUsers = %v, want changed", got.UpdateUsers)
+	}
+	want := []PlanMembership{
+		{Username: "changed", Remove: []string{"admins"}},
+		{Username: "new", Add: []string{"staff"}},
+	}
+	if !reflect.DeepEqual(got.GroupChanges, want) {
+		t.Errorf("buildPlan() GroupChanges = %v, want %v", got.GroupChanges, want)
+	}
+}
+
+func Test_applyPlan(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{Deprovision: DeprovisionDelete, SyncGroups: true, SendEnrollEmail: true}}
+	users, groups := testPlanSets()
+	state := newState()
+	plan, _ := buildPlan(conf, users, groups, state, DeprovisionDelete, now)
+
+	result := applyPlan(plan, users, groups, state, conf.DuoAPI, nil, now, true)
+	if result.Errors != 0 || result.Changes != plan.changes() {
+		t.Errorf("applyPlan() = %+v, want %d changes", result, plan.changes())
+	}
+	if !state.Users["new"].LastEnrollEmail.Equal(now) {
+		t.Errorf("applyPlan() didn't record the enrollment of new")
+	}
+
+	plan.UpdateUsers = append(plan.UpdateUsers, PlanUser{Username: "unknown"})
+	result = applyPlan(plan, users, groups, state, conf.DuoAPI, nil, now, true)
+	if result.Errors != 1 || result.Changes != 0 {
+		t.Errorf("applyPlan() with an unknown user = %+v, want 1 error and no changes", result)
+	}
+}
+
+func Test_applyPlanSharedName(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{SyncGroups: true, SendEnrollEmail: true}}
+
+	// User private groups share the name of their user
+	sets := func() (UserSet, GroupSet) {
+		users := UserSet{
+			"jsmith": {Username: "jsmith", Email: "jsmith@example.com", LDAP: true, MemberOf: map[string]bool{"jsmith": true, "staff": true}},
+			"bjones": {
+				Username: "bjones", DuoUserID: "DU2", Email: "bjones@example.com", DuoEmail: "bjones@example.com",
+				DuoEnrolled: true, LDAP: true, Duo: true, MemberOf: map[string]bool{"jsmith": true},
+			},
+		}
+		users.markUpdates()
+		groups := GroupSet{
+			"jsmith": {Name: "jsmith", LDAP: true},
+			"staff":  {Name: "staff", DuoGroupID: "DG1", DuoDesc: managedGroupMarker, LDAP: true, Duo: true, Managed: true},
+		}
+		groups.markUpdates()
+		return users, groups
+	}
+
+	tests := []struct {
+		name        string
+		failPath    string
+		wantRequest string
+	}{
+		{name: "Group creation fails", failPath: "/admin/v1/groups", wantRequest: "POST /admin/v1/users/DU9/groups"},
+		{name: "User creation fails", failPath: "/admin/v1/users", wantRequest: "POST /admin/v1/users/DU2/groups"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := map[string]bool{}
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests[r.Method+" "+r.URL.Path] = true
+				mu.Unlock()
+				switch r.URL.Path {
+				case tt.failPath:
+					fmt.Fprintln(w, `{"stat": "FAIL", "code": 40003, "message": "Duplicate resource"}`)
+				case "/admin/v1/groups":
+					fmt.Fprintln(w, `{"stat": "OK", "response": {"group_id": "DG9", "name": "jsmith"}}`)
+				case "/admin/v1/users":
+					fmt.Fprintln(w, `{"stat": "OK", "response": {"user_id": "DU9", "username": "jsmith"}}`)
+				default:
+					fmt.Fprintln(w, `{"stat": "OK", "response": ""}`)
+				}
+			}))
+			defer ts.Close()
+
+			users, groups := sets()
+			state := newState()
+			plan, _ := buildPlan(conf, users, groups, state, DeprovisionNone, now)
+			result := applyPlan(plan, users, groups, state, conf.DuoAPI, buildAdminClient(ts.URL, nil), now, false)
+			if result.Errors != 1 {
+				t.Errorf("applyPlan() Errors = %d, want 1", result.Errors)
+			}
+			if !requests[tt.wantRequest] {
+				t.Errorf("applyPlan() requests = %v, want %s", requests, tt.wantRequest)
+			}
+			if tt.failPath == "/admin/v1/groups" && !requests["POST /admin/v1/users/enroll"] {
+				t.Errorf("applyPlan() didn't enroll jsmith after failing to create group jsmith")
+			}
+		})
+	}
+}
+
+func Test_applyPlanRecordedChanges(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{}}
+
+	var mu sync.Mutex
+	sent := map[string]url.Values{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		sent[r.URL.Path] = r.Form
+		mu.Unlock()
+		fmt.Fprintln(w, `{"stat": "OK", "response": {"user_id": "DU9", "username": "new"}}`)
+	}))
+	defer ts.Close()
+
+	users, groups := testPlanSets()
+	plan, _ := buildPlan(conf, users, groups, newState(), DeprovisionNone, now)
+
+	// A reviewer edits the plan before it's applied
+	delete(plan.UpdateUsers[0].Changes, "email")
+	plan.UpdateUsers[0].Changes["lastname"] = PlanChange{New: "Reviewed"}
+	plan.CreateUsers[0].Changes["email"] = PlanChange{New: "reviewed@example.com"}
+
+	applyPlan(plan, users, groups, newState(), conf.DuoAPI, buildAdminClient(ts.URL, nil), now, false)
+
+	if got := sent["/admin/v1/users/DU2"]; got.Get("email") != "" || got.Get("lastname") != "Reviewed" {
+		t.Errorf("applyPlan() updated changed with %v, want only the recorded lastname", got)
+	}
+	if got := sent["/admin/v1/users"]; got.Get("email") != "reviewed@example.com" || got.Get("username") != "new" {
+		t.Errorf("applyPlan() created new with %v, want the recorded email", got)
+	}
+}
+
+func Test_fingerprint(t *testing.T) {
+	conf := &DuoAPI{Skey: "secret", EnrollValidSeconds: 3600}
+	users, groups := testPlanSets()
+	before := fingerprint(conf, users, groups)
+
+	sameUsers, sameGroups := testPlanSets()
+	if got := fingerprint(&DuoAPI{Skey: "rotated", EnrollValidSeconds: 3600}, sameUsers, sameGroups); got != before {
+		t.Errorf("fingerprint() = %s, want %s for the same sets and settings", got, before)
+	}
+
+	if got := fingerprint(&DuoAPI{Skey: "secret", EnrollValidSeconds: 60}, users, groups); got == before {
+		t.Errorf("fingerprint() should change when a duo_api setting changes")
+	}
+
+	users["same"].DuoEmail = "other@example.com"
+	if got := fingerprint(conf, users, groups); got == before {
+		t.Errorf("fingerprint() should change when a Duo attribute changes")
+	}
+}
+
+func Test_writePlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duoldapsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{Deprovision: DeprovisionDelete, SyncGroups: true, SendEnrollEmail: true}}
+	users, groups := testPlanSets()
+	plan, _ := buildPlan(conf, users, groups, newState(), DeprovisionDelete, now)
+
+	path := filepath.Join(dir, "plan.json")
+	if err := writePlan(path, plan); err != nil {
+		t.Fatalf("writePlan() error = %v", err)
+	}
+	got, err := readPlan(path)
+	if err != nil {
+		t.Fatalf("readPlan() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, plan) {
+		t.Errorf("readPlan() = %+v, want %+v", got, plan)
+	}
+
+	if _, err := readPlan(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("readPlan() of a missing file should fail")
+	}
+}
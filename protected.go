@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// protectedMatcher matches users against ProtectedUsers.
+type protectedMatcher struct {
+	usernames map[string]bool
+	patterns  []string
+	regexps   []*regexp.Regexp
+	groups    map[string]bool
+}
+
+// newProtectedMatcher checks and compiles the patterns and regular expressions of p, which may be nil.
+func newProtectedMatcher(p *ProtectedUsers) (*protectedMatcher, error) {
+	m := &protectedMatcher{usernames: map[string]bool{}, groups: map[string]bool{}}
+	if p == nil {
+		return m, nil
+	}
+
+	for _, username := range p.Usernames {
+		m.usernames[username] = true
+	}
+	for _, pattern := range p.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		m.patterns = append(m.patterns, pattern)
+	}
+	for _, expr := range p.Regexps {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q: %v", expr, err)
+		}
+		m.regexps = append(m.regexps, re)
+	}
+	for _, group := range p.Groups {
+		m.groups[group] = true
+	}
+	return m, nil
+}
+
+// matches returns true if the user's username matches or the user is a member of a protected Duo group.
+func (m *protectedMatcher) matches(user *User) bool {
+	if m.usernames[user.Username] {
+		return true
+	}
+	for _, pattern := range m.patterns {
+		if ok, _ := path.Match(pattern, user.Username); ok {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(user.Username) {
+			return true
+		}
+	}
+	for _, group := range user.DuoGroups {
+		if m.groups[group] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func Test_protectedMatcher(t *testing.T) {
+	p := &ProtectedUsers{
+		Usernames: []string{"breakglass"},
+		Patterns:  []string{"svc-*"},
+		Regexps:   []string{"^admin[0-9]+$"},
+		Groups:    []string{"Protected Admins"},
+	}
+	m, err := newProtectedMatcher(p)
+	if err != nil {
+		t.Fatalf("newProtectedMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		user *User
+		want bool
+	}{
+		{name: "Username", user: &User{Username: "breakglass"}, want: true},
+		{name: "Username prefix", user: &User{Username: "breakglass2"}, want: false},
+		{name: "Pattern", user: &User{Username: "svc-backup"}, want: true},
+		{name: "Regexp", user: &User{Username: "admin01"}, want: true},
+		{name: "Regexp anchored", user: &User{Username: "admin01x"}, want: false},
+		{name: "Group", user: &User{Username: "jsmith", DuoGroups: []string{"staff", "Protected Admins"}}, want: true},
+		{name: "Not protected", user: &User{Username: "jsmith", DuoGroups: []string{"staff"}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.matches(tt.user); got != tt.want {
+				t.Errorf("protectedMatcher.matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newProtectedMatcher(&ProtectedUsers{Patterns: []string{"svc-["}}); err == nil {
+		t.Errorf("newProtectedMatcher() with an invalid pattern should fail")
+	}
+	if _, err := newProtectedMatcher(&ProtectedUsers{Regexps: []string{"admin("}}); err == nil {
+		t.Errorf("newProtectedMatcher() with an invalid regexp should fail")
+	}
+}
@@ -39,6 +39,7 @@ install -d %{buildroot}/%{_sysconfdir}/sysconfig
 install -m 0644 rpm/%{name}.sysconfig %{buildroot}/%{_sysconfdir}/sysconfig/%{name}
 install -d %{buildroot}%{_sysconfdir}/duoldapsync
 install -m 0644 examples/duoldapconfig.json %{buildroot}%{_sysconfdir}/%{name}/duoldapsync.json.example
+install -d -m 0750 %{buildroot}%{_sharedstatedir}/%{name}
 
 %pre
 getent group duoldapsync >/dev/null || groupadd -r duoldapsync
@@ -70,6 +71,7 @@ rm -rf %{buildroot}
 %{_unitdir}/%{name}.service
 %config %{_sysconfdir}/sysconfig/%{name}
 %{_sysconfdir}/%{name}/duoldapsync.json.example
+%dir %attr(0750,duoldapsync,duoldapsync) %{_sharedstatedir}/%{name}
 
 
 %changelog
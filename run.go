@@ -1,132 +1,510 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"gopkg.in/ldap.v2"
+	ldap "gopkg.in/ldap.v2"
 
 	duoapi "github.com/duosecurity/duo_api_golang"
 	"github.com/duosecurity/duo_api_golang/admin"
 )
 
+// Exit codes used in one-shot mode
+const (
+	exitNoChanges = 0
+	exitErrors    = 1
+	exitChanges   = 2
+)
+
+// syncResult summarizes the outcome of a sync cycle
+type syncResult struct {
+	Changes int // Number of changes made in Duo, or that would have been made in dry-run mode
+	Errors  int // Number of errors encountered
+}
+
+// add accumulates the changes and errors of other into r.
+func (r *syncResult) add(other syncResult) {
+	r.Changes += other.Changes
+	r.Errors += other.Errors
+}
+
+// exitCode maps the result of a sync cycle to the exit code of a one-shot run.
+func (r syncResult) exitCode() int {
+	if r.Errors > 0 {
+		return exitErrors
+	} else if r.Changes > 0 {
+		return exitChanges
+	}
+	return exitNoChanges
+}
+
+func newDuoClient(conf *DuoAPI) *admin.Client {
+	duoAPI := duoapi.NewDuoApi(conf.Ikey, conf.Skey, conf.APIHost, "Duoldapsync", duoapi.SetTimeout(10*time.Second))
+	return admin.New(*duoAPI)
+}
+
+// runOnce performs a single sync cycle and returns its result.
+func runOnce(conf DuoLDAPSyncConfig, dryRun bool) (syncResult, error) {
+	l, err := newLDAPConn(conf.LDAPServers)
+	if err != nil {
+		return syncResult{}, fmt.Errorf("connection to LDAP server(s) failed: %v", err)
+	}
+	defer l.close()
+
+	return syncCycle(conf, l, newDuoClient(conf.DuoAPI), dryRun), nil
+}
+
+// runAdopt claims the existing Duo users found in LDAP that don't carry the ownership marker yet by adding the marker
+// to their notes, so they are managed in ownership mode. Protected users are left alone.
+func runAdopt(conf DuoLDAPSyncConfig, dryRun bool) (syncResult, error) {
+	l, err := newLDAPConn(conf.LDAPServers)
+	if err != nil {
+		return syncResult{}, fmt.Errorf("connection to LDAP server(s) failed: %v", err)
+	}
+	defer l.close()
+
+	client := newDuoClient(conf.DuoAPI)
+	userSet, _, err := collectSets(conf, l, client)
+	if err != nil {
+		return syncResult{}, err
+	}
+
+	result := syncResult{}
+	marker := conf.DuoAPI.ownershipMarker()
+	for _, user := range userSet.adoptable() {
+		if debug {
+			log.Printf("Adopting Duo user: %s", user.Username)
+		}
+		if err := user.duoAdopt(client, marker, dryRun); err != nil {
+			log.Printf("Duo User Adopt Failed, %s", err)
+			result.Errors++
+		} else {
+			result.Changes++
+		}
+	}
+	log.Printf("Adopted %d Duo users", result.Changes)
+
+	return result, nil
+}
+
 func run(conf DuoLDAPSyncConfig, dryRun bool) error {
-	l, err := connect(conf.LDAPServers)
+	l, err := newLDAPConn(conf.LDAPServers)
 	if err != nil {
 		return fmt.Errorf("connection to LDAP server(s) failed: %v", err)
 	}
-	defer l.Close()
 
-	duoAPI := duoapi.NewDuoApi(conf.DuoAPI.Ikey, conf.DuoAPI.Skey, conf.DuoAPI.APIHost, "Duoldapsync", duoapi.SetTimeout(10*time.Second))
-	client := admin.New(*duoAPI)
+	client := newDuoClient(conf.DuoAPI)
 
-	// Loop forever sleeping pollTime seconds between iterations.
+	// Loop until stopped, sleeping pollTime seconds between iterations.
 	ticker := time.NewTicker(time.Second * time.Duration(pollTime))
-	done := make(chan bool)
+	defer ticker.Stop()
+	reload := make(chan DuoLDAPSyncConfig, 1)
+	stop := make(chan struct{})
+	done := make(chan bool, 1)
 
-	go tickerLoop(ticker, conf, l, client, dryRun, done)
+	// Catch signals before the first sync cycle starts, so it isn't interrupted partway through
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
 
-	// Wait for tickerLoop to exit
-	<-done
-	close(done)
+	// tickerLoop owns the LDAP connection from here on, including closing it
+	go tickerLoop(ticker, conf, l, client, dryRun, reload, stop, done)
 
-	return nil
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				newConf, err := loadConfig(configPath)
+				if err != nil {
+					log.Printf("Configuration reload failed, keeping the current configuration: %v", err)
+					continue
+				}
+				// Replace a reload tickerLoop hasn't picked up yet with the newest config
+				select {
+				case <-reload:
+				default:
+				}
+				reload <- newConf
+				continue
+			}
+
+			// Wait for tickerLoop to finish the current cycle and exit
+			timeout := time.Second * time.Duration(shutdownTimeout)
+			log.Printf("Received %s, shutting down after the current sync cycle finishes", sig)
+			ticker.Stop()
+			close(stop)
+			select {
+			case <-done:
+				return nil
+			case <-time.After(timeout):
+				return fmt.Errorf("sync cycle did not finish within %s of shutdown", timeout)
+			}
+		case <-done:
+			return nil
+		}
+	}
 }
 
-func tickerLoop(ticker *time.Ticker, conf DuoLDAPSyncConfig, ldapConn *ldap.Conn, client *admin.Client, dryRun bool, done chan bool) {
+func tickerLoop(ticker *time.Ticker, conf DuoLDAPSyncConfig, ldapConn *ldapConn, client *admin.Client, dryRun bool, reload chan DuoLDAPSyncConfig, stop chan struct{}, done chan bool) {
+	// Tell run() tickerLoop is done
+	defer func() { done <- true }()
+	defer func() { ldapConn.close() }()
 
-	// MaxDeleteUsers needs to be 1 or greater to make sense. Disable DeleteUsers
-	// to disable user deletion instead of trying to set MaxDeleteUsers to 0.
-	maxDeleteUsers := 1
-	if conf.DuoAPI.MaxDeleteUsers > 0 {
-		maxDeleteUsers = conf.DuoAPI.MaxDeleteUsers
-	}
+	// Sync right away instead of waiting pollTime seconds for the first tick
+	syncCycle(conf, ldapConn, client, dryRun)
 
-	for range ticker.C {
-		sr, err := enumUsers(ldapConn, conf.LDAPUserSearch)
-		if err != nil {
-			log.Printf("%v\n", err)
-			continue
-		}
+	for {
+		select {
+		case <-stop:
+			return
+		case newConf := <-reload:
+			l, err := newLDAPConn(newConf.LDAPServers)
+			if err != nil {
+				log.Printf("Configuration reload failed, keeping the current configuration: connection to LDAP server(s) failed: %v", err)
+				continue
+			}
+			ldapConn.close()
+			ldapConn = l
+			client = newDuoClient(newConf.DuoAPI)
+			conf = newConf
+			log.Printf("Configuration reloaded from %s", configPath)
 
-		if debug {
-			log.Printf("LDAP found %d results", len(sr.Entries))
+			// Sync right away so changes take effect without waiting for the next tick
+			syncCycle(conf, ldapConn, client, dryRun)
+		case <-ticker.C:
+			// Prefer stopping when a tick and stop arrive together
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			syncCycle(conf, ldapConn, client, dryRun)
 		}
+	}
+}
 
-		// Skip the rest of the loop so we avoid deleting all Duo users accidently
-		if len(sr.Entries) == 0 {
-			log.Print("WARNING no LDAP results found, skipping")
-			continue
+// syncCycle performs a single synchronization of users from LDAP into Duo.
+func syncCycle(conf DuoLDAPSyncConfig, ldapConn *ldapConn, client *admin.Client, dryRun bool) syncResult {
+	result := syncResult{}
+	now := time.Now()
+
+	userSet, groupSet, err := collectSets(conf, ldapConn, client)
+	if err != nil {
+		log.Printf("%v\n", err)
+		result.Errors++
+		return result
+	}
+
+	state, deprovision, stateOK := observeState(conf, userSet, now, dryRun)
+	if !stateOK && conf.stateRequired() {
+		result.Errors++
+	}
+
+	plan, planResult := buildPlan(conf, userSet, groupSet, state, deprovision, now)
+	result.add(planResult)
+	if !stateOK {
+		plan.dropEnrollments()
+	}
+	result.add(applyPlan(plan, userSet, groupSet, state, conf.DuoAPI, client, now, dryRun))
+	printSummary(plan, dryRun)
+
+	if stateOK && !dryRun {
+		if err := state.save(conf.stateDir()); err != nil {
+			log.Printf("Saving state to %s failed, %v", conf.stateDir(), err)
+			result.Errors++
 		}
+	}
 
-		userSet := UserSet{}
-		userSet.addLDAPEntries(sr.Entries, conf.LDAPUserSearch)
+	return result
+}
+
+// printSummary prints the changes in plan to stdout in dry-run mode, or when requested with --summary.
+func printSummary(plan *Plan, dryRun bool) {
+	title := "Sync cycle changes:"
+	if dryRun {
+		title = "Dry run changes, nothing was changed in Duo:"
+	} else if !summary {
+		return
+	}
+	if err := plan.writeSummary(os.Stdout, title); err != nil {
+		log.Printf("Writing summary failed, %v", err)
+	}
+}
 
-		duoUsers, err := client.GetUsers()
+// collectSets gathers the users and groups of a sync cycle from LDAP and Duo. The returned GroupSet is nil unless
+// groups are synced.
+func collectSets(conf DuoLDAPSyncConfig, ldapConn *ldapConn, client *admin.Client) (UserSet, GroupSet, error) {
+	l, err := ldapConn.get()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Connection to LDAP server(s) failed, %v", err)
+	}
+
+	sr, err := enumUsers(l, conf.LDAPUserSearch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if debug {
+		log.Printf("LDAP found %d results", len(sr.Entries))
+	}
+
+	// Skip the rest of the cycle so we avoid deleting all Duo users accidently
+	if len(sr.Entries) == 0 {
+		return nil, nil, errors.New("WARNING no LDAP results found, skipping")
+	}
+
+	userSet := UserSet{}
+	userSet.addLDAPEntries(sr.Entries, conf.LDAPUserSearch)
+
+	var groupSet GroupSet
+	if conf.groupsRequired() {
+		groupSet, err = ldapGroups(l, conf, userSet)
 		if err != nil {
-			log.Printf("Duo Users Enumeration Fail, %s", err)
-			continue
-		} else if duoUsers.Stat != "OK" {
-			log.Printf("Duo API returned status when attemping user enumeration: %s", duoUsers.Stat)
-			continue
+			return nil, nil, err
 		}
 
-		userSet.addDuoResults(duoUsers)
+		// Skip the rest of the cycle if include_groups and exclude_groups filtered out every LDAP user, eg. after a
+		// group was renamed, rather than deprovisioning all Duo users
+		if len(userSet) == 0 {
+			return nil, nil, errors.New("WARNING no LDAP users left after applying include_groups and exclude_groups, skipping")
+		}
+	}
 
-		usersDeleteOverflow := false
-		usersDelete := make([]*User, 0, maxDeleteUsers)
+	duoUsers, err := GetAllUsers(client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Duo Users Enumeration Fail, %s", err)
+	}
 
+	if conf.DuoAPI.deprovision() == DeprovisionDisable {
+		// Re-enable users disabled by deprovisioning that have reappeared in LDAP. Only users recorded in the state as
+		// disabled by duoldapsync are re-enabled, see User.updateValues
 		for _, user := range userSet {
-			if !user.Duo {
-				if debug {
-					log.Printf("Creating Duo user: %s", user.Username)
-				}
-				err := user.duoCreate(client, dryRun)
-				if err != nil {
-					log.Printf("Duo User Creation Failed, %s", err)
-					break
-				}
-				if conf.DuoAPI.SendEnrollEmail {
-					if debug {
-						log.Printf("Enrolling Duo user: %s", user.Username)
-					}
-					err := user.duoEnroll(client, conf.DuoAPI.EnrollValidSeconds, dryRun)
-					if err != nil {
-						log.Printf("Duo User Enrollment Failed, %s", err)
-					}
-				}
-			} else if user.Duo && !user.LDAP && conf.DuoAPI.DeleteUsers {
-				if len(usersDelete) < cap(usersDelete) {
-					usersDelete = append(usersDelete, user)
-				} else {
-					usersDeleteOverflow = true
-				}
+			if user.LDAP && user.Status == "" {
+				user.Status = duoStatusActive
 			}
 		}
+	}
+
+	userSet.addDuoResults(duoUsers)
+	userSet.markUpdates()
+	if err := userSet.markProtected(conf.DuoAPI.Protected); err != nil {
+		return nil, nil, fmt.Errorf("duo_api protected: %v", err)
+	}
+	userSet.markOwned(conf.DuoAPI.ownershipMarker())
+
+	if !conf.DuoAPI.SyncGroups {
+		// Group membership is only synced along with groups
+		return userSet, nil, nil
+	}
+
+	duoGroups, err := GetAllGroups(client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Duo Groups Enumeration Fail, %s", err)
+	}
+
+	groupSet.addDuoResults(duoGroups)
+	groupSet.markUpdates()
 
-		// Clear usersDelete if overflown (eg. gone over MaxDeleteUsers). Otherwise delete users.
-		if usersDeleteOverflow {
-			log.Printf("WARNING more users to delete than the configured DuoAPI.MaxDeleteUsers setting of %d allows, no users will be deleted", maxDeleteUsers)
-		} else if len(usersDelete) > 0 {
-			deleteUsers(client, usersDelete, dryRun)
+	return userSet, groupSet, nil
+}
+
+// observeState loads the bookkeeping kept between sync cycles and records what the cycle started at now found in
+// userSet, marking the users duoldapsync disabled. It returns the deprovisioning mode to use and false if the state
+// couldn't be loaded or the state directory isn't writable, in which case the cycle continues from an empty state,
+// users aren't deprovisioned when a grace period applies, disabled users aren't re-enabled, the Plan's enrollments
+// must be dropped, and the state file should be left as is. When readOnly, as in dry runs and plan, which never save
+// the state, the state directory is left untouched rather than checked for writability.
+func observeState(conf DuoLDAPSyncConfig, userSet UserSet, now time.Time, readOnly bool) (*State, string, bool) {
+	deprovision := conf.DuoAPI.deprovision()
+
+	state, err := loadState(conf.stateDir())
+	if err == nil && !readOnly {
+		err = checkWritable(conf.stateDir())
+	}
+	if err != nil {
+		log.Printf("WARNING state in %s can't be loaded or saved: %v", conf.stateDir(), err)
+		state = newState()
+		if deprovision != DeprovisionNone && conf.DuoAPI.hasGrace() {
+			log.Print("WARNING no users will be deprovisioned without state to track the grace period")
+			deprovision = DeprovisionNone
 		}
 	}
+	state.observe(userSet, now)
+	userSet.markSyncDisabled(state)
 
-	// Tell run() tickerLoop is done
-	done <- true
+	return state, deprovision, err == nil
+}
+
+// syncUserGroups adds and removes the user from Duo groups.
+func syncUserGroups(client *admin.Client, user *User, add []*Group, remove []*Group, dryRun bool) syncResult {
+	result := syncResult{}
+
+	for _, group := range add {
+		if debug {
+			log.Printf("Adding Duo user %s to group %s", user.Username, group.Name)
+		}
+		resp, err := AddUserGroup(client, user.DuoUserID, group.DuoGroupID, dryRun)
+		if err != nil {
+			log.Printf("Duo User Group Add Fail, %s", err)
+			result.Errors++
+		} else if resp.Stat != "OK" {
+			log.Printf("Duo API returned status %d when attemping to add user %s to group %s", resp.Code, user.Username, group.Name)
+			result.Errors++
+		} else {
+			result.Changes++
+		}
+	}
+
+	for _, group := range remove {
+		if debug {
+			log.Printf("Removing Duo user %s from group %s", user.Username, group.Name)
+		}
+		resp, err := RemoveUserGroup(client, user.DuoUserID, group.DuoGroupID, dryRun)
+		if err != nil {
+			log.Printf("Duo User Group Remove Fail, %s", err)
+			result.Errors++
+		} else if resp.Stat != "OK" {
+			log.Printf("Duo API returned status %d when attemping to remove user %s from group %s", resp.Code, user.Username, group.Name)
+			result.Errors++
+		} else {
+			result.Changes++
+		}
+	}
+
+	return result
+}
+
+// enrollUsers sends an enrollment email to each user, recording the emails sent in state.
+func enrollUsers(client *admin.Client, users []*User, state *State, conf *DuoAPI, now time.Time, dryRun bool) syncResult {
+	result := syncResult{}
+	for _, user := range users {
+		if debug {
+			log.Printf("Enrolling Duo user: %s", user.Username)
+		}
+		if err := user.duoEnroll(client, conf.EnrollValidSeconds, dryRun); err != nil {
+			log.Printf("Duo User Enrollment Failed, %s", err)
+			result.Errors++
+		} else {
+			result.Changes++
+			state.enrolled(user.Username, now)
+		}
+	}
+	return result
 }
 
-func deleteUsers(client *admin.Client, users []*User, dryRun bool) {
+// deprovisionUsers deletes or disables users in Duo depending on the deprovision mode, recording disabled users in
+// state.
+func deprovisionUsers(client *admin.Client, users []*User, state *State, deprovision string, dryRun bool) syncResult {
+	result := syncResult{}
 	for _, user := range users {
+		if deprovision == DeprovisionDisable {
+			if debug {
+				log.Printf("Disabling Duo user: %s", user.Username)
+			}
+			if err := user.duoDisable(client, dryRun); err != nil {
+				log.Printf("Duo User Disable Fail, %s", err)
+				result.Errors++
+			} else {
+				result.Changes++
+				state.disabled(user.Username)
+			}
+			continue
+		}
+
 		if debug {
 			log.Printf("Deleting Duo user: %s", user.Username)
 		}
 		resp, err := DeleteUser(client, user.DuoUserID, dryRun)
 		if err != nil {
 			log.Printf("Duo User Delete Fail, %s", err)
+			result.Errors++
 		} else if resp.Stat != "OK" {
 			log.Printf("Duo API returned status %d when attemping to delete user %s", resp.Code, user.Username)
+			result.Errors++
+		} else {
+			result.Changes++
 		}
 	}
+	return result
+}
+
+// ldapGroups enumerates LDAP groups, resolves the group membership of the users in userSet, and removes users from
+// userSet based on the include and exclude groups of LDAPUserSearch.
+func ldapGroups(l *ldap.Conn, conf DuoLDAPSyncConfig, userSet UserSet) (GroupSet, error) {
+	// Group membership of groups themselves is only needed to walk nested groups
+	var membershipAttr string
+	if conf.LDAPGroupSearch.NestedGroups {
+		membershipAttr = conf.LDAPUserSearch.GroupMembershipAttr
+	}
+
+	sr, err := enumGroups(l, conf.LDAPGroupSearch, membershipAttr)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP Groups Enumeration Fail, %s", err)
+	}
+
+	if debug {
+		log.Printf("LDAP found %d groups", len(sr.Entries))
+	}
+
+	groupSet := GroupSet{}
+	groupSet.addLDAPEntries(sr.Entries, conf.LDAPGroupSearch, membershipAttr)
+	groupSet.resolveMembers(userSet, conf.LDAPGroupSearch.membership())
+
+	if conf.LDAPGroupSearch.NestedGroups {
+		if err := resolveNestedGroups(l, conf, groupSet, userSet); err != nil {
+			return nil, err
+		}
+	}
+
+	include, err := groupSet.resolveNames(conf.LDAPUserSearch.IncludeGroups)
+	if err != nil {
+		return nil, fmt.Errorf("include_groups: %v", err)
+	}
+	exclude, err := groupSet.resolveNames(conf.LDAPUserSearch.ExcludeGroups)
+	if err != nil {
+		return nil, fmt.Errorf("exclude_groups: %v", err)
+	}
+	userSet.filterGroups(include, exclude)
+
+	return groupSet, nil
+}
+
+// resolveNestedGroups adds membership through nested groups to the users in userSet, using LDAP_MATCHING_RULE_IN_CHAIN
+// searches when the server supports them and otherwise walking the group graph in groupSet.
+func resolveNestedGroups(l *ldap.Conn, conf DuoLDAPSyncConfig, groupSet GroupSet, userSet UserSet) error {
+	inChain, err := supportsInChain(l)
+	if err != nil {
+		return fmt.Errorf("LDAP root DSE search failed: %v", err)
+	}
+
+	if !inChain {
+		if debug {
+			log.Print("LDAP server doesn't support LDAP_MATCHING_RULE_IN_CHAIN, walking nested groups")
+		}
+		groupSet.resolveNested(userSet)
+		return nil
+	}
+
+	for _, group := range groupSet {
+		if !group.LDAP {
+			continue
+		}
+		sr, err := enumGroupMembersInChain(l, conf.LDAPUserSearch, group.DN)
+		if err != nil {
+			return fmt.Errorf("LDAP nested group members search for %s failed: %v", group.Name, err)
+		}
+		for _, entry := range sr.Entries {
+			if user, ok := userSet[entry.GetAttributeValue(conf.LDAPUserSearch.UserAttr)]; ok && user.LDAP {
+				user.MemberOf[group.Name] = true
+			}
+		}
+	}
+
+	return nil
 }
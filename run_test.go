@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncResult_exitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		result syncResult
+		want   int
+	}{
+		{name: "No changes", result: syncResult{}, want: exitNoChanges},
+		{name: "Changes", result: syncResult{Changes: 3}, want: exitChanges},
+		{name: "Errors", result: syncResult{Errors: 1}, want: exitErrors},
+		{name: "Changes and errors", result: syncResult{Changes: 3, Errors: 1}, want: exitErrors},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.result.exitCode(); got != tt.want {
+				t.Errorf("syncResult.exitCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tickerLoopStop(t *testing.T) {
+	// Without any LDAP servers each cycle fails immediately at connect
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{}, LDAPUserSearch: &LDAPUserSearch{}}
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	stop := make(chan struct{})
+	done := make(chan bool, 1)
+
+	go tickerLoop(ticker, conf, &ldapConn{}, nil, true, make(chan DuoLDAPSyncConfig), stop, done)
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tickerLoop() did not exit after stop was closed")
+	}
+}
+
+func Test_observeState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duoldapsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A state directory below a regular file can't be created
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name            string
+		stateDir        string
+		readOnly        bool
+		wantOK          bool
+		wantEnrollUsers int
+	}{
+		{name: "Writable", stateDir: filepath.Join(dir, "state"), wantOK: true, wantEnrollUsers: 1},
+		{name: "Not writable", stateDir: filepath.Join(file, "state"), wantOK: false, wantEnrollUsers: 0},
+		{name: "Read only isn't probed", stateDir: filepath.Join(dir, "readonly"), readOnly: true, wantOK: true, wantEnrollUsers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DuoLDAPSyncConfig{
+				DuoAPI: &DuoAPI{SendEnrollEmail: true},
+				State:  &StateConfig{Dir: tt.stateDir},
+			}
+			users, groups := testPlanSets()
+
+			state, deprovision, ok := observeState(conf, users, now, tt.readOnly)
+			if ok != tt.wantOK {
+				t.Fatalf("observeState() ok = %v, want %v", ok, tt.wantOK)
+			}
+			plan, _ := buildPlan(conf, users, groups, state, deprovision, now)
+			if !ok {
+				plan.dropEnrollments()
+			}
+			if len(plan.EnrollUsers) != tt.wantEnrollUsers {
+				t.Errorf("Plan EnrollUsers = %v, want %d users", plan.EnrollUsers, tt.wantEnrollUsers)
+			}
+			if _, err := os.Stat(tt.stateDir); tt.readOnly && !os.IsNotExist(err) {
+				t.Errorf("observeState() read only created %s", tt.stateDir)
+			}
+		})
+	}
+}
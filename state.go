@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFileName is the name of the state file within the state directory
+const stateFileName = "state.json"
+
+// State is the bookkeeping duoldapsync keeps on disk so it survives between sync cycles and restarts.
+type State struct {
+	Users map[string]*UserState `json:"users"` // Sync metadata of users in LDAP or Duo, indexed by username
+}
+
+// UserState is the sync metadata recorded for a user.
+type UserState struct {
+	DuoUserID       string    `json:"duo_user_id,omitempty"`
+	LastSeenLDAP    time.Time `json:"last_seen_ldap"`             // Start of the last sync cycle the user was found in LDAP
+	LastEnrollEmail time.Time `json:"last_enroll_email"`          // When an enrollment email was last sent to the user
+	EnrollReminders int       `json:"enroll_reminders,omitempty"` // Number of enrollment emails sent to the user after the first
+	AttrHash        string    `json:"attr_hash,omitempty"`        // Hash of the attributes last applied to the Duo user, see User.attrHash
+	FirstMissing    time.Time `json:"first_missing"`              // Start of the first sync cycle the user was missing from LDAP in
+	MissingCycles   int       `json:"missing_cycles,omitempty"`   // Number of consecutive sync cycles the user has been missing from LDAP
+	Disabled        bool      `json:"disabled,omitempty"`         // Duo user was disabled by duoldapsync rather than by an admin
+}
+
+// newState returns an empty State.
+func newState() *State {
+	return &State{Users: map[string]*UserState{}}
+}
+
+// loadState reads the state file from dir. A missing state file results in an empty State.
+func loadState(dir string) (*State, error) {
+	s := newState()
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFileName))
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Users == nil {
+		s.Users = map[string]*UserState{}
+	}
+	return s, nil
+}
+
+// Save writes the state file to dir, creating dir if needed. The state is written to a temporary file first and
+// renamed over the state file, so a crash never leaves a partially written state file behind.
+func (s *State) save(dir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, stateFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, stateFileName))
+}
+
+// checkWritable checks that the state file can be written to dir, creating dir if needed, so a cycle can refuse
+// changes that rely on the state being saved before making them.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, stateFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// User returns the recorded state of a user, adding an empty record if there is none.
+func (s *State) user(username string) *UserState {
+	if _, ok := s.Users[username]; !ok {
+		s.Users[username] = &UserState{}
+	}
+	return s.Users[username]
+}
+
+// Observe records what a sync cycle started at now found in LDAP and Duo. Users found in LDAP are marked as seen,
+// Duo users not in LDAP are counted as missing for one more cycle, and users in neither are forgotten. Duo users
+// recorded for the first time, like all of them when the state starts out empty, are treated as having been sent an
+// enrollment email already, so only users created by duoldapsync get an initial one.
+func (s *State) observe(users UserSet, now time.Time) {
+	for username := range s.Users {
+		if _, ok := users[username]; !ok {
+			delete(s.Users, username)
+		}
+	}
+
+	for username, user := range users {
+		_, known := s.Users[username]
+		record := s.user(username)
+		if !known && user.Duo {
+			record.LastEnrollEmail = now
+		}
+		if user.Duo {
+			record.DuoUserID = user.DuoUserID
+		} else {
+			record.DuoUserID = ""
+			record.Disabled = false
+		}
+
+		if user.LDAP {
+			record.LastSeenLDAP = now
+			record.FirstMissing = time.Time{}
+			record.MissingCycles = 0
+		} else {
+			if record.MissingCycles == 0 {
+				record.FirstMissing = now
+			}
+			record.MissingCycles++
+		}
+	}
+}
+
+// Applied records the Duo user ID, the attributes and the status of a user that was just created or updated in Duo.
+func (s *State) applied(user *User) {
+	record := s.user(user.Username)
+	record.DuoUserID = user.DuoUserID
+	record.AttrHash = user.attrHash()
+	switch user.Status {
+	case duoStatusDisabled:
+		record.Disabled = true
+	case duoStatusActive:
+		record.Disabled = false
+	}
+}
+
+// Disabled records that duoldapsync disabled a user in Duo, so the user is re-enabled if it reappears in LDAP.
+func (s *State) disabled(username string) {
+	s.user(username).Disabled = true
+}
+
+// Enrolled records that an enrollment email was sent to a user at now, counting it as a reminder if an email was
+// sent before.
+func (s *State) enrolled(username string, now time.Time) {
+	record := s.user(username)
+	if !record.LastEnrollEmail.IsZero() {
+		record.EnrollReminders++
+	}
+	record.LastEnrollEmail = now
+}
+
+// EnrollDue returns true if an enrollment email should be sent to a user who hasn't enrolled, either because none
+// has been sent yet, or because EnrollReminderSeconds have passed since the last one and fewer than
+// MaxEnrollReminders reminders have been sent.
+func (s *State) enrollDue(username string, c *DuoAPI, now time.Time) bool {
+	record, ok := s.Users[username]
+	if !ok || record.LastEnrollEmail.IsZero() {
+		return true
+	}
+	if c.EnrollReminderSeconds <= 0 || record.EnrollReminders >= c.MaxEnrollReminders {
+		return false
+	}
+	return now.Sub(record.LastEnrollEmail) >= time.Second*time.Duration(c.EnrollReminderSeconds)
+}
+
+// GraceElapsed returns true if the user has been missing from LDAP for at least DeprovisionGraceCycles cycles and
+// the DeprovisionGrace duration as of now.
+func (s *State) graceElapsed(username string, c *DuoAPI, now time.Time) bool {
+	record, ok := s.Users[username]
+	if !ok || record.MissingCycles == 0 {
+		return false
+	}
+	return record.MissingCycles >= c.DeprovisionGraceCycles && now.Sub(record.FirstMissing) >= c.graceDuration()
+}
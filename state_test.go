@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_loadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duoldapsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := loadState(dir)
+	if err != nil {
+		t.Fatalf("loadState() without a state file error = %v", err)
+	}
+	if len(s.Users) != 0 {
+		t.Errorf("loadState() without a state file Users = %v, want empty", s.Users)
+	}
+
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	s.Users["jsmith"] = &UserState{DuoUserID: "DU1", LastSeenLDAP: now, LastEnrollEmail: now, AttrHash: "abc"}
+	s.Users["bjones"] = &UserState{DuoUserID: "DU2", FirstMissing: now, MissingCycles: 2}
+	if err := s.save(dir); err != nil {
+		t.Fatalf("State.save() error = %v", err)
+	}
+
+	got, err := loadState(dir)
+	if err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("loadState() = %v, want %v", got, s)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != stateFileName {
+		t.Errorf("State.save() left files %v, want only %s", files, stateFileName)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, stateFileName), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(dir); err == nil {
+		t.Errorf("loadState() with a corrupt state file should fail")
+	}
+}
+
+func TestState_observe(t *testing.T) {
+	first := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	now := first.Add(time.Hour)
+
+	s := &State{Users: map[string]*UserState{
+		"jsmith":   {DuoUserID: "DU1", LastSeenLDAP: first, FirstMissing: first, MissingCycles: 1}, // Still missing
+		"bjones":   {DuoUserID: "DU2", LastSeenLDAP: first, FirstMissing: first, MissingCycles: 3}, // Back in LDAP
+		"deleted":  {DuoUserID: "DU3", FirstMissing: first, MissingCycles: 1},                      // Gone from Duo and LDAP
+		"recreate": {DuoUserID: "DU4", LastSeenLDAP: first, LastEnrollEmail: first},                // Deleted from Duo
+	}}
+	users := UserSet{
+		"jsmith":   {Username: "jsmith", DuoUserID: "DU1", Duo: true},
+		"bjones":   {Username: "bjones", DuoUserID: "DU2", Duo: true, LDAP: true},
+		"recreate": {Username: "recreate", LDAP: true},
+		"new":      {Username: "new", DuoUserID: "DU5", Duo: true},
+		"ldap":     {Username: "ldap", LDAP: true},
+	}
+
+	s.observe(users, now)
+
+	want := map[string]*UserState{
+		"jsmith":   {DuoUserID: "DU1", LastSeenLDAP: first, FirstMissing: first, MissingCycles: 2},
+		"bjones":   {DuoUserID: "DU2", LastSeenLDAP: now},
+		"recreate": {LastSeenLDAP: now, LastEnrollEmail: first},
+		"new":      {DuoUserID: "DU5", LastEnrollEmail: now, FirstMissing: now, MissingCycles: 1},
+		"ldap":     {LastSeenLDAP: now},
+	}
+	if !reflect.DeepEqual(s.Users, want) {
+		t.Errorf("State.observe() Users = %v, want %v", s.Users, want)
+	}
+}
+
+func TestState_applied(t *testing.T) {
+	now := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	s := newState()
+	user := &User{Username: "jsmith", DuoUserID: "DU1", Email: "jsmith@example.com"}
+
+	s.applied(user)
+	s.enrolled("jsmith", now)
+
+	want := &UserState{DuoUserID: "DU1", LastEnrollEmail: now, AttrHash: user.attrHash()}
+	if !reflect.DeepEqual(s.Users["jsmith"], want) {
+		t.Errorf("State.applied() = %v, want %v", s.Users["jsmith"], want)
+	}
+
+	user.Email = "john.smith@example.com"
+	if user.attrHash() == want.AttrHash {
+		t.Errorf("User.attrHash() should change with the email")
+	}
+
+	user.Status = duoStatusDisabled
+	s.applied(user)
+	if !s.Users["jsmith"].Disabled {
+		t.Errorf("State.applied() of a disabled user didn't record Disabled")
+	}
+	user.Status = duoStatusActive
+	s.applied(user)
+	if s.Users["jsmith"].Disabled {
+		t.Errorf("State.applied() of a re-enabled user kept Disabled")
+	}
+}
+
+func TestState_graceElapsed(t *testing.T) {
+	first := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	s := &State{Users: map[string]*UserState{
+		"jsmith": {FirstMissing: first, MissingCycles: 3},
+		"bjones": {LastSeenLDAP: first},
+	}}
+
+	tests := []struct {
+		name     string
+		username string
+		c        *DuoAPI
+		now      time.Time
+		want     bool
+	}{
+		{name: "Unknown", username: "unknown", c: &DuoAPI{DeprovisionGraceCycles: 1}, now: first, want: false},
+		{name: "Not missing", username: "bjones", c: &DuoAPI{DeprovisionGrace: "1h"}, now: first.Add(2 * time.Hour), want: false},
+		{name: "Cycles elapsed", username: "jsmith", c: &DuoAPI{DeprovisionGraceCycles: 3}, now: first, want: true},
+		{name: "Cycles not elapsed", username: "jsmith", c: &DuoAPI{DeprovisionGraceCycles: 4}, now: first, want: false},
+		{name: "Duration elapsed", username: "jsmith", c: &DuoAPI{DeprovisionGrace: "72h"}, now: first.Add(72 * time.Hour), want: true},
+		{name: "Duration not elapsed", username: "jsmith", c: &DuoAPI{DeprovisionGrace: "72h"}, now: first.Add(71 * time.Hour), want: false},
+		{name: "Cycles elapsed but not duration", username: "jsmith", c: &DuoAPI{DeprovisionGraceCycles: 2, DeprovisionGrace: "72h"}, now: first.Add(time.Hour), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.graceElapsed(tt.username, tt.c, tt.now); got != tt.want {
+				t.Errorf("State.graceElapsed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestState_enrollDue(t *testing.T) {
+	last := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	s := &State{Users: map[string]*UserState{
+		"jsmith":   {LastSeenLDAP: last},
+		"bjones":   {LastEnrollEmail: last},
+		"reminded": {LastEnrollEmail: last, EnrollReminders: 2},
+	}}
+	reminders := &DuoAPI{EnrollReminderSeconds: 86400, MaxEnrollReminders: 2}
+
+	tests := []struct {
+		name     string
+		username string
+		c        *DuoAPI
+		now      time.Time
+		want     bool
+	}{
+		{name: "No record", username: "new", c: &DuoAPI{}, now: last, want: true},
+		{name: "Never sent", username: "jsmith", c: &DuoAPI{}, now: last, want: true},
+		{name: "Sent without reminders", username: "bjones", c: &DuoAPI{}, now: last.Add(365 * 24 * time.Hour), want: false},
+		{name: "Reminder not yet due", username: "bjones", c: reminders, now: last.Add(23 * time.Hour), want: false},
+		{name: "Reminder due", username: "bjones", c: reminders, now: last.Add(24 * time.Hour), want: true},
+		{name: "Reminders exhausted", username: "reminded", c: reminders, now: last.Add(72 * time.Hour), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.enrollDue(tt.username, tt.c, tt.now); got != tt.want {
+				t.Errorf("State.enrollDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestState_enrolled(t *testing.T) {
+	first := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+	s := newState()
+
+	s.enrolled("jsmith", first)
+	if got := s.Users["jsmith"]; !got.LastEnrollEmail.Equal(first) || got.EnrollReminders != 0 {
+		t.Errorf("State.enrolled() first email = %v", got)
+	}
+
+	s.enrolled("jsmith", second)
+	if got := s.Users["jsmith"]; !got.LastEnrollEmail.Equal(second) || got.EnrollReminders != 1 {
+		t.Errorf("State.enrolled() reminder = %v", got)
+	}
+}
+
+func Test_checkWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duoldapsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateDir := filepath.Join(dir, "state")
+	if err := checkWritable(stateDir); err != nil {
+		t.Fatalf("checkWritable() error = %v", err)
+	}
+	files, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("checkWritable() left files %v behind", files)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritable(filepath.Join(file, "state")); err == nil {
+		t.Errorf("checkWritable() below a regular file should fail")
+	}
+}
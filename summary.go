@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// writeSummary writes the changes in the plan to w as a table of the users and groups to change, with the attributes
+// that change from their old to their new value, followed by totals. Empty cells are shown as -.
+func (p *Plan) writeSummary(w io.Writer, title string) error {
+	fmt.Fprintln(w, title)
+	if p.changes() == 0 {
+		_, err := fmt.Fprintln(w, "No changes")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tNAME\tATTRIBUTE\tOLD\tNEW")
+
+	for _, g := range p.CreateGroups {
+		writeGroupRow(tw, "create group", g)
+	}
+	for _, g := range p.UpdateGroups {
+		writeGroupRow(tw, "update group", g)
+	}
+	for _, g := range p.DeleteGroups {
+		writeGroupRow(tw, "delete group", g)
+	}
+	for _, u := range p.CreateUsers {
+		writeUserRows(tw, "create user", u)
+	}
+	for _, u := range p.UpdateUsers {
+		writeUserRows(tw, "update user", u)
+	}
+	for _, u := range p.EnrollUsers {
+		writeUserRows(tw, "enroll user", u)
+	}
+	for _, u := range p.DisableUsers {
+		writeUserRows(tw, "disable user", u)
+	}
+	for _, u := range p.DeleteUsers {
+		writeUserRows(tw, "delete user", u)
+	}
+	for _, m := range p.GroupChanges {
+		for _, name := range m.Add {
+			fmt.Fprintf(tw, "add to group\t%s\tgroup\t-\t%s\n", m.Username, name)
+		}
+		for _, name := range m.Remove {
+			fmt.Fprintf(tw, "remove from group\t%s\tgroup\t%s\t-\n", m.Username, name)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	memberships := 0
+	for _, m := range p.GroupChanges {
+		memberships += len(m.Add) + len(m.Remove)
+	}
+	_, err := fmt.Fprintf(w, "Users: %d to create, %d to update, %d to enroll, %d to disable, %d to delete. "+
+		"Groups: %d to create, %d to update, %d to delete. Group memberships: %d to change.\n",
+		len(p.CreateUsers), len(p.UpdateUsers), len(p.EnrollUsers), len(p.DisableUsers), len(p.DeleteUsers),
+		len(p.CreateGroups), len(p.UpdateGroups), len(p.DeleteGroups), memberships)
+	return err
+}
+
+// writeUserRows writes a row for each attribute change of a user, or a single row if no attributes change.
+func writeUserRows(w io.Writer, action string, u PlanUser) {
+	if len(u.Changes) == 0 {
+		fmt.Fprintf(w, "%s\t%s\t-\t-\t-\n", action, u.Username)
+		return
+	}
+
+	params := make([]string, 0, len(u.Changes))
+	for param := range u.Changes {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	for _, param := range params {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", action, u.Username, param, orDash(u.Changes[param].Old), orDash(u.Changes[param].New))
+	}
+}
+
+// writeGroupRow writes a row for a group, including its description change if any.
+func writeGroupRow(w io.Writer, action string, g PlanGroup) {
+	if g.Desc == nil {
+		fmt.Fprintf(w, "%s\t%s\t-\t-\t-\n", action, g.Name)
+		return
+	}
+	fmt.Fprintf(w, "%s\t%s\tdesc\t%s\t%s\n", action, g.Name, orDash(g.Desc.Old), orDash(g.Desc.New))
+}
+
+// orDash returns value, or - if value is empty, so empty cells in the summary table are visible.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
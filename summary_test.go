@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPlan_writeSummary(t *testing.T) {
+	conf := DuoLDAPSyncConfig{DuoAPI: &DuoAPI{Deprovision: DeprovisionDelete, SyncGroups: true, SendEnrollEmail: true}}
+	users, groups := testPlanSets()
+	plan, _ := buildPlan(conf, users, groups, newState(), DeprovisionDelete, time.Now())
+
+	tests := []struct {
+		name string
+		plan *Plan
+		want string
+	}{
+		{
+			name: "No changes",
+			plan: &Plan{},
+			want: "Planned changes:\nNo changes\n",
+		},
+		{
+			name: "Changes",
+			plan: plan,
+			want: `Planned changes:
+ACTION             NAME     ATTRIBUTE  OLD              NEW
+create group       staff    desc       -                Staff [duoldapsync]
+delete group       old      -          -                -
+create user        new      email      -                new@example.com
+create user        new      notes      -                [duoldapsync]
+create user        new      status     -                active
+update user        changed  email      old@example.com  new@example.com
+enroll user        new      -          -                -
+delete user        gone     -          -                -
+remove from group  changed  group      admins           -
+add to group       new      group      -                staff
+Users: 1 to create, 1 to update, 1 to enroll, 0 to disable, 1 to delete. Groups: 1 to create, 0 to update, 1 to delete. Group memberships: 2 to change.
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.plan.writeSummary(&buf, "Planned changes:"); err != nil {
+				t.Fatalf("Plan.writeSummary() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("Plan.writeSummary() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
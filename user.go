@@ -1,37 +1,62 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/duosecurity/duo_api_golang/admin"
 	ldap "gopkg.in/ldap.v2"
 )
 
+// Duo user statuses managed by duoldapsync. Users with other statuses, like bypass and locked out, are only ever
+// changed to disabled, see User.updateValues.
+const (
+	duoStatusActive   = "active"
+	duoStatusDisabled = "disabled"
+)
+
 // User represents the attributes of a user found in LDAP and records if the user has been found in Duo.
 type User struct {
+	DN        string
 	Username  string
 	DuoUserID string
 	FullName  string
 	Email     string
 	FirstName string
 	LastName  string
+	Groups    []string        // Values of the LDAP group membership attribute, typically group DNs
+	MemberOf  map[string]bool // Names of the LDAP groups the user is a member of, see GroupSet.resolveMembers
+	Status    string          // Duo status the user should have, active or disabled, or empty if not managed
 
-	LDAP        bool // User found in LDAP
-	Duo         bool // User found in Duo
-	NeedsUpdate bool // Indicates LDAP attributes are different that what is in Duo, and the Duo user needs to be updated.
+	// Attributes of the user as they are currently set in Duo
+	DuoFullName  string
+	DuoEmail     string
+	DuoFirstName string
+	DuoLastName  string
+	DuoGroups    []string // Names of the Duo groups the user is a member of
+	DuoStatus    string
+	DuoEnrolled  bool // User has enrolled at least one authentication device in Duo
+	DuoNotes     string
+
+	LDAP         bool // User found in LDAP
+	Duo          bool // User found in Duo
+	NeedsUpdate  bool // Indicates LDAP attributes are different that what is in Duo, and the Duo user needs to be updated.
+	Protected    bool // Duo user matches DuoAPI.Protected and is never updated, disabled or deleted
+	Owned        bool // Duo user carries the ownership marker in its notes, see DuoAPI.Ownership
+	SyncDisabled bool // Duo user was disabled by duoldapsync, so it may be re-enabled, see UserState.Disabled
 }
 
-// DuoCreate creates a user via the Duo Admin API
-func (u *User) duoCreate(client *admin.Client, dryRun bool) error {
-	params, err := u.urlValues()
-	if err != nil {
-		return fmt.Errorf("URLValues failed: %s when attempting to create user: %s", err, u.Username)
-	}
-	params.Set("status", "active")
-	//params.Set("notes", ...) TODO: Add lastUpdated
+// DuoCreate creates a user with the attributes in params, eg. from createValues, via the Duo Admin API. The user is
+// owned if its notes carry the ownership marker.
+func (u *User) duoCreate(client *admin.Client, params url.Values, marker string, dryRun bool) error {
+	params.Set("username", u.Username)
 	result, err := CreateUser(client, params, dryRun)
 
 	if err != nil {
@@ -39,6 +64,58 @@ func (u *User) duoCreate(client *admin.Client, dryRun bool) error {
 	} else if result.Stat != "OK" {
 		return fmt.Errorf("CreateUser Duo API returned non-ok status when attemping to create user: %s with message: %v", u.Username, result.Message)
 	}
+
+	u.DuoUserID = result.Response.UserID
+	u.DuoNotes = params.Get("notes")
+	u.Owned = strings.Contains(u.DuoNotes, marker)
+	return nil
+}
+
+// DuoUpdate updates the attributes in params of an existing user via the Duo Admin API, eg. the attributes that
+// differ from LDAP from updateValues
+func (u *User) duoUpdate(client *admin.Client, params url.Values, dryRun bool) error {
+	result, err := UpdateUser(client, u.DuoUserID, params, dryRun)
+
+	if err != nil {
+		return fmt.Errorf("UpdateUser failed: %s when attempting to update user: %s", err, u.Username)
+	} else if result.Stat != "OK" {
+		return fmt.Errorf("UpdateUser Duo API returned non-ok status when attemping to update user: %s with message: %v", u.Username, result.Message)
+	}
+	return nil
+}
+
+// DuoAdopt claims an existing Duo user by adding the ownership marker to the user's notes via the Duo Admin API
+func (u *User) duoAdopt(client *admin.Client, marker string, dryRun bool) error {
+	notes := marker
+	if u.DuoNotes != "" {
+		notes = u.DuoNotes + " " + marker
+	}
+	params := url.Values{}
+	params.Set("notes", notes)
+	result, err := UpdateUser(client, u.DuoUserID, params, dryRun)
+
+	if err != nil {
+		return fmt.Errorf("UpdateUser failed: %s when attempting to adopt user: %s", err, u.Username)
+	} else if result.Stat != "OK" {
+		return fmt.Errorf("UpdateUser Duo API returned non-ok status when attemping to adopt user: %s with message: %v", u.Username, result.Message)
+	}
+
+	u.DuoNotes = notes
+	u.Owned = true
+	return nil
+}
+
+// DuoDisable sets the status of a user to disabled via the Duo Admin API
+func (u *User) duoDisable(client *admin.Client, dryRun bool) error {
+	params := url.Values{}
+	params.Set("status", duoStatusDisabled)
+	result, err := UpdateUser(client, u.DuoUserID, params, dryRun)
+
+	if err != nil {
+		return fmt.Errorf("UpdateUser failed: %s when attempting to disable user: %s", err, u.Username)
+	} else if result.Stat != "OK" {
+		return fmt.Errorf("UpdateUser Duo API returned non-ok status when attemping to disable user: %s with message: %v", u.Username, result.Message)
+	}
 	return nil
 }
 
@@ -51,13 +128,23 @@ func (u *User) duoEnroll(client *admin.Client, enrollValidSecs int, dryRun bool)
 
 	result, err := EnrollUser(client, enrollParams, dryRun)
 	if err != nil {
-		return fmt.Errorf("CreateUser failed: %s when attempting to create user: %s", err, u.Username)
+		return fmt.Errorf("EnrollUser failed: %s when attempting to enroll user: %s", err, u.Username)
 	} else if result.Stat != "OK" {
-		return fmt.Errorf("CreateUser Duo API returned non-ok status when attemping to create user: %s with message: %v", u.Username, result.Message)
+		return fmt.Errorf("EnrollUser Duo API returned non-ok status when attemping to enroll user: %s with message: %v", u.Username, result.Message)
 	}
 	return nil
 }
 
+// Enrollable returns true if the user should be sent an enrollment email, because they haven't enrolled in Duo, have
+// an email address and are or will be active.
+func (u *User) enrollable() bool {
+	status := u.Status
+	if status == "" {
+		status = u.DuoStatus
+	}
+	return !u.DuoEnrolled && u.Email != "" && (status == "" || status == duoStatusActive)
+}
+
 // URLValues transforms User's attributes into url.Values
 func (u *User) urlValues() (url.Values, error) {
 	params := url.Values{}
@@ -81,6 +168,90 @@ func (u *User) urlValues() (url.Values, error) {
 	return params, nil
 }
 
+// AttrHash returns a hash of the LDAP attributes and status synced to Duo, used to record what was last applied.
+func (u *User) attrHash() string {
+	params, err := u.urlValues()
+	if err != nil {
+		return ""
+	}
+	if u.Status != "" {
+		params.Set("status", u.Status)
+	}
+	sum := sha256.Sum256([]byte(params.Encode()))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateValues returns the url.Values to create the user in Duo with, including its status and the ownership marker
+// in notes.
+func (u *User) createValues(marker string) (url.Values, error) {
+	params, err := u.urlValues()
+	if err != nil {
+		return nil, err
+	}
+	params.Set("status", duoStatusActive)
+	if u.Status != "" {
+		params.Set("status", u.Status)
+	}
+	params.Set("notes", marker)
+	return params, nil
+}
+
+// UpdateValues returns the url.Values of the LDAP attributes that differ from Duo. Like urlValues, empty
+// LDAP attributes are skipped, so an unset attribute in LDAP never clears the value in Duo. Users disabled in LDAP
+// are disabled whatever their Duo status, eg. bypass or locked out, but only disabled users are re-enabled, and only
+// if duoldapsync disabled them.
+func (u *User) updateValues() url.Values {
+	params := url.Values{}
+	switch {
+	case u.Status == duoStatusDisabled && u.DuoStatus != duoStatusDisabled:
+		params.Set("status", duoStatusDisabled)
+	case u.Status == duoStatusActive && u.DuoStatus == duoStatusDisabled && u.SyncDisabled:
+		params.Set("status", duoStatusActive)
+	}
+	if u.FullName != "" && u.FullName != u.DuoFullName {
+		params.Set("realname", u.FullName)
+	}
+	if u.Email != "" && u.Email != u.DuoEmail {
+		params.Set("email", u.Email)
+	}
+	if u.FirstName != "" && u.FirstName != u.DuoFirstName {
+		params.Set("firstname", u.FirstName)
+	}
+	if u.LastName != "" && u.LastName != u.DuoLastName {
+		params.Set("lastname", u.LastName)
+	}
+	return params
+}
+
+// GroupChanges compares the user's LDAP group membership to their Duo group membership and returns the groups the
+// user needs to be added to and removed from in Duo. Only groups in LDAP that are managed by duoldapsync are considered.
+// GroupSet.resolveMembers must be called first to populate MemberOf.
+func (u *User) groupChanges(groups GroupSet) (add []*Group, remove []*Group) {
+	want := map[string]bool{}
+	for name := range u.MemberOf {
+		if group, ok := groups[name]; ok && group.LDAP && group.Managed {
+			want[name] = true
+		}
+	}
+
+	have := map[string]bool{}
+	for _, name := range u.DuoGroups {
+		have[name] = true
+		if group, ok := groups[name]; ok && group.LDAP && group.Managed && !want[name] {
+			remove = append(remove, group)
+		}
+	}
+
+	for name := range want {
+		if !have[name] {
+			add = append(add, groups[name])
+		}
+	}
+
+	sort.Slice(add, func(i, j int) bool { return add[i].Name < add[j].Name })
+	return add, remove
+}
+
 // UserSet is a map of Users indexed by username
 type UserSet map[string]*User
 
@@ -93,6 +264,7 @@ func (u UserSet) addLDAPEntries(entries []*ldap.Entry, ldapUserSearch *LDAPUserS
 		var email string
 		var firstName string
 		var lastName string
+		var groups []string
 
 		for _, attr := range entry.Attributes {
 			if attr.Name == ldapUserSearch.UserAttr {
@@ -115,6 +287,8 @@ func (u UserSet) addLDAPEntries(entries []*ldap.Entry, ldapUserSearch *LDAPUserS
 				if len(attr.Values) != 0 {
 					lastName = attr.Values[0]
 				}
+			} else if attr.Name == ldapUserSearch.GroupMembershipAttr {
+				groups = attr.Values
 			}
 		}
 
@@ -129,23 +303,127 @@ func (u UserSet) addLDAPEntries(entries []*ldap.Entry, ldapUserSearch *LDAPUserS
 			u[user] = &User{LDAP: true}
 		}
 
+		u[user].DN = entry.DN
 		u[user].Username = user
 		u[user].FullName = fullName
 		u[user].Email = email
 		u[user].FirstName = firstName
 		u[user].LastName = lastName
+		u[user].Groups = groups
+		if ldapUserSearch.detectsDisabled() {
+			u[user].Status = duoStatusActive
+			if ldapUserSearch.isDisabled(entry, time.Now()) {
+				u[user].Status = duoStatusDisabled
+			}
+		}
+	}
+}
+
+// FilterGroups removes LDAP users from the UserSet that aren't a member of any of the include groups, when include
+// is not empty, or are a member of any of the exclude groups. GroupSet.resolveMembers must be called first to populate
+// MemberOf, and the filter must be applied before adding Duo results so filtered users are treated as not in LDAP.
+func (u UserSet) filterGroups(include []*Group, exclude []*Group) {
+	for name, user := range u {
+		if !user.LDAP {
+			continue
+		}
+
+		keep := len(include) == 0
+		for _, group := range include {
+			if user.MemberOf[group.Name] {
+				keep = true
+				break
+			}
+		}
+		for _, group := range exclude {
+			if user.MemberOf[group.Name] {
+				keep = false
+				break
+			}
+		}
+
+		if !keep {
+			if debug {
+				log.Printf("Skipping LDAP user %s based on include_groups and exclude_groups", name)
+			}
+			delete(u, name)
+		}
 	}
 }
 
 // AddDuoResults iterates over a UsersResult from the Duo Admin API and marks the Duo attribute in a User in the UserSet
-// to show that the user already exist in Duo.
-func (u UserSet) addDuoResults(result *admin.GetUsersResult) {
+// to show that the user already exist in Duo, recording the user's current Duo attributes.
+func (u UserSet) addDuoResults(result *GetUsersResult) {
 	for _, dUser := range result.Response {
 		if _, ok := u[dUser.Username]; ok {
 			u[dUser.Username].Duo = true
-			u[dUser.Username].DuoUserID = dUser.UserID
 		} else {
-			u[dUser.Username] = &User{Duo: true, Username: dUser.Username, DuoUserID: dUser.UserID}
+			u[dUser.Username] = &User{Duo: true, Username: dUser.Username}
+		}
+
+		u[dUser.Username].DuoUserID = dUser.UserID
+		u[dUser.Username].DuoFullName = dUser.RealName
+		u[dUser.Username].DuoEmail = dUser.Email
+		u[dUser.Username].DuoFirstName = dUser.FirstName
+		u[dUser.Username].DuoLastName = dUser.LastName
+		u[dUser.Username].DuoStatus = dUser.Status
+		u[dUser.Username].DuoEnrolled = dUser.IsEnrolled
+		u[dUser.Username].DuoNotes = dUser.Notes
+
+		var duoGroups []string
+		for _, group := range dUser.Groups {
+			duoGroups = append(duoGroups, group.Name)
 		}
+		u[dUser.Username].DuoGroups = duoGroups
+	}
+}
+
+// MarkProtected sets Protected on Duo users matching the protected usernames, patterns and Duo groups in p.
+// AddDuoResults must be called first to populate DuoGroups.
+func (u UserSet) markProtected(p *ProtectedUsers) error {
+	m, err := newProtectedMatcher(p)
+	if err != nil {
+		return err
+	}
+	for _, user := range u {
+		user.Protected = user.Duo && m.matches(user)
+	}
+	return nil
+}
+
+// MarkOwned sets Owned on Duo users whose notes contain the ownership marker.
+func (u UserSet) markOwned(marker string) {
+	for _, user := range u {
+		user.Owned = user.Duo && strings.Contains(user.DuoNotes, marker)
+	}
+}
+
+// Adoptable returns the users the adopt command claims, sorted by username: users found in both LDAP and Duo that
+// don't carry the ownership marker yet and aren't protected.
+func (u UserSet) adoptable() []*User {
+	users := []*User{}
+	for _, user := range u {
+		if user.LDAP && user.Duo && !user.Owned && !user.Protected {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// MarkSyncDisabled sets SyncDisabled on Duo users that state records as disabled by duoldapsync, and updates
+// NeedsUpdate accordingly.
+func (u UserSet) markSyncDisabled(state *State) {
+	for username, user := range u {
+		record, ok := state.Users[username]
+		user.SyncDisabled = user.Duo && ok && record.Disabled
+	}
+	u.markUpdates()
+}
+
+// MarkUpdates sets NeedsUpdate on users found in both LDAP and Duo whose LDAP attributes differ from Duo.
+func (u UserSet) markUpdates() {
+	for _, user := range u {
+		user.NeedsUpdate = user.LDAP && user.Duo && len(user.updateValues()) > 0
 	}
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/duosecurity/duo_api_golang/admin"
@@ -14,23 +18,67 @@ func TestUserSet_addLDAPEntries(t *testing.T) {
 		entries        []*ldap.Entry
 		ldapUserSearch *LDAPUserSearch
 	}
+	search := &LDAPUserSearch{
+		UserAttr:            "uid",
+		GroupMembershipAttr: "memberOf",
+		EmailAttr:           "mail",
+		FullNameAttr:        "displayName",
+		FirstNameAttr:       "givenName",
+		LastNameAttr:        "sn",
+	}
+
 	tests := []struct {
-		name string
-		u    UserSet
-		args args
+		name  string
+		u     UserSet
+		args  args
+		wants UserSet
 	}{
-		// TODO: Add test cases.
+		{
+			name: "User with groups",
+			args: args{
+				entries: []*ldap.Entry{
+					ldap.NewEntry("uid=jsmith,ou=people,dc=example,dc=com", map[string][]string{
+						"uid":         {"jsmith"},
+						"mail":        {"jsmith@example.com"},
+						"displayName": {"Joe Smith"},
+						"givenName":   {"Joe"},
+						"sn":          {"Smith"},
+						"memberOf":    {"cn=admins,ou=groups,dc=example,dc=com", "cn=users,ou=groups,dc=example,dc=com"},
+					}),
+				},
+				ldapUserSearch: search,
+			},
+			u: UserSet{},
+			wants: UserSet{"jsmith": &User{
+				LDAP: true, DN: "uid=jsmith,ou=people,dc=example,dc=com", Username: "jsmith", Email: "jsmith@example.com", FullName: "Joe Smith", FirstName: "Joe", LastName: "Smith",
+				Groups: []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=users,ou=groups,dc=example,dc=com"},
+			}},
+		},
+		{
+			name: "Missing user attribute",
+			args: args{
+				entries: []*ldap.Entry{
+					ldap.NewEntry("uid=jsmith,ou=people,dc=example,dc=com", map[string][]string{"mail": {"jsmith@example.com"}}),
+				},
+				ldapUserSearch: search,
+			},
+			u:     UserSet{},
+			wants: UserSet{},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.u.addLDAPEntries(tt.args.entries, tt.args.ldapUserSearch)
+			if !reflect.DeepEqual(tt.u, tt.wants) {
+				t.Fatalf("Mismatch between result %v and wants %v", tt.u, tt.wants)
+			}
 		})
 	}
 }
 
 func TestUserSet_addDuoResults(t *testing.T) {
 	type args struct {
-		result *admin.GetUsersResult
+		result *GetUsersResult
 	}
 
 	tests := []struct {
@@ -42,11 +90,11 @@ func TestUserSet_addDuoResults(t *testing.T) {
 		{
 			name: "example1 Single User",
 			args: args{
-				result: &admin.GetUsersResult{
-					Response: []admin.User{
-						{
+				result: &GetUsersResult{
+					Response: []DuoUser{
+						{User: admin.User{
 							Username: "example1",
-						},
+						}},
 					},
 				},
 			},
@@ -56,17 +104,44 @@ func TestUserSet_addDuoResults(t *testing.T) {
 		{
 			name: "Existing User and New User",
 			args: args{
-				result: &admin.GetUsersResult{
-					Response: []admin.User{
-						{
+				result: &GetUsersResult{
+					Response: []DuoUser{
+						{User: admin.User{
 							Username: "example2",
-						},
+						}},
 					},
 				},
 			},
 			u:     UserSet{"example1": &User{Duo: false, LDAP: true, Username: "example1"}},
 			wants: UserSet{"example1": &User{Duo: false, LDAP: true, Username: "example1"}, "example2": &User{Duo: true, Username: "example2"}},
 		},
+		{
+			name: "Existing User Duo attributes",
+			args: args{
+				result: &GetUsersResult{
+					Response: []DuoUser{
+						{
+							User: admin.User{
+								Username:  "example1",
+								UserID:    "DU1",
+								RealName:  "Example Old",
+								Email:     "old@example.com",
+								FirstName: "Example",
+								LastName:  "Old",
+							},
+							IsEnrolled: true,
+						},
+					},
+				},
+			},
+			u: UserSet{"example1": &User{LDAP: true, Username: "example1", FullName: "Example One", Email: "one@example.com"}},
+			wants: UserSet{"example1": &User{
+				Duo: true, LDAP: true, Username: "example1", DuoUserID: "DU1",
+				FullName: "Example One", Email: "one@example.com",
+				DuoFullName: "Example Old", DuoEmail: "old@example.com", DuoFirstName: "Example", DuoLastName: "Old",
+				DuoEnrolled: true,
+			}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -140,3 +215,279 @@ func TestUser_urlValues(t *testing.T) {
 		})
 	}
 }
+
+func TestUser_updateValues(t *testing.T) {
+	tests := []struct {
+		name string
+		user User
+		want url.Values
+	}{
+		{
+			name: "No changes",
+			user: User{Username: "test1", FullName: "Test One", DuoFullName: "Test One", Email: "test@example.com", DuoEmail: "test@example.com"},
+			want: url.Values{},
+		},
+		{
+			name: "Changed email and last name",
+			user: User{Username: "test1", Email: "new@example.com", DuoEmail: "old@example.com", LastName: "Two", DuoLastName: "One"},
+			want: url.Values{
+				"email":    []string{"new@example.com"},
+				"lastname": []string{"Two"},
+			},
+		},
+		{
+			name: "Re-enable user disabled by duoldapsync",
+			user: User{Username: "test1", Status: "active", DuoStatus: "disabled", SyncDisabled: true},
+			want: url.Values{"status": []string{"active"}},
+		},
+		{
+			name: "User disabled by an admin left alone",
+			user: User{Username: "test1", Status: "active", DuoStatus: "disabled"},
+			want: url.Values{},
+		},
+		{
+			name: "Bypass status left alone",
+			user: User{Username: "test1", Status: "active", DuoStatus: "bypass"},
+			want: url.Values{},
+		},
+		{
+			name: "Disable bypass user",
+			user: User{Username: "test1", Status: "disabled", DuoStatus: "bypass"},
+			want: url.Values{"status": []string{"disabled"}},
+		},
+		{
+			name: "Disable locked out user",
+			user: User{Username: "test1", Status: "disabled", DuoStatus: "locked out"},
+			want: url.Values{"status": []string{"disabled"}},
+		},
+		{
+			name: "Empty LDAP attribute doesn't clear Duo",
+			user: User{Username: "test1", DuoFullName: "Test One", DuoFirstName: "Test"},
+			want: url.Values{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.updateValues(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("User.updateValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUser_enrollable(t *testing.T) {
+	tests := []struct {
+		name string
+		user User
+		want bool
+	}{
+		{name: "New user", user: User{Username: "test1", Email: "test@example.com"}, want: true},
+		{name: "Already enrolled", user: User{Username: "test1", Email: "test@example.com", DuoEnrolled: true}, want: false},
+		{name: "No email", user: User{Username: "test1"}, want: false},
+		{name: "Disabled in LDAP", user: User{Username: "test1", Email: "test@example.com", Status: "disabled", DuoStatus: "active"}, want: false},
+		{name: "Disabled in Duo", user: User{Username: "test1", Email: "test@example.com", DuoStatus: "disabled"}, want: false},
+		{name: "Re-enabled", user: User{Username: "test1", Email: "test@example.com", Status: "active", DuoStatus: "disabled"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.enrollable(); got != tt.want {
+				t.Errorf("User.enrollable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserSet_markUpdates(t *testing.T) {
+	u := UserSet{
+		"changed":   &User{LDAP: true, Duo: true, Username: "changed", Email: "new@example.com", DuoEmail: "old@example.com"},
+		"unchanged": &User{LDAP: true, Duo: true, Username: "unchanged", Email: "same@example.com", DuoEmail: "same@example.com"},
+		"ldapOnly":  &User{LDAP: true, Username: "ldapOnly", Email: "new@example.com"},
+		"duoOnly":   &User{Duo: true, Username: "duoOnly", DuoEmail: "old@example.com"},
+	}
+	u.markUpdates()
+
+	wants := map[string]bool{"changed": true, "unchanged": false, "ldapOnly": false, "duoOnly": false}
+	for name, want := range wants {
+		if u[name].NeedsUpdate != want {
+			t.Errorf("UserSet.markUpdates() %s NeedsUpdate = %v, want %v", name, u[name].NeedsUpdate, want)
+		}
+	}
+}
+
+func TestUserSet_markOwned(t *testing.T) {
+	u := UserSet{
+		"owned":    &User{Duo: true, Username: "owned", DuoNotes: "Contractor " + managedGroupMarker},
+		"unowned":  &User{Duo: true, Username: "unowned", DuoNotes: "Contractor"},
+		"ldapOnly": &User{LDAP: true, Username: "ldapOnly"},
+	}
+	u.markOwned(managedGroupMarker)
+
+	wants := map[string]bool{"owned": true, "unowned": false, "ldapOnly": false}
+	for name, want := range wants {
+		if u[name].Owned != want {
+			t.Errorf("UserSet.markOwned() %s Owned = %v, want %v", name, u[name].Owned, want)
+		}
+	}
+}
+
+func TestUser_duoAdopt(t *testing.T) {
+	tests := []struct {
+		name      string
+		notes     string
+		response  string
+		wantNotes string
+		wantErr   bool
+	}{
+		{
+			name:      "Marker appended to notes",
+			notes:     "Contractor",
+			response:  `{"stat": "OK", "response": {"user_id": "DU1", "username": "jsmith"}}`,
+			wantNotes: "Contractor " + managedGroupMarker,
+		},
+		{
+			name:      "Empty notes",
+			response:  `{"stat": "OK", "response": {"user_id": "DU1", "username": "jsmith"}}`,
+			wantNotes: managedGroupMarker,
+		},
+		{
+			name:     "Non-OK stat",
+			notes:    "Contractor",
+			response: `{"stat": "FAIL", "code": 40401, "message": "Resource not found"}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath, gotNotes string
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+				if err := r.ParseForm(); err == nil {
+					gotNotes = r.PostForm.Get("notes")
+				}
+				fmt.Fprintln(w, tt.response)
+			}))
+			defer ts.Close()
+
+			u := &User{Username: "jsmith", DuoUserID: "DU1", DuoNotes: tt.notes, LDAP: true, Duo: true}
+			err := u.duoAdopt(buildAdminClient(ts.URL, nil), managedGroupMarker, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("User.duoAdopt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotPath != "/admin/v1/users/DU1" {
+				t.Errorf("User.duoAdopt() requested path %s", gotPath)
+			}
+			if tt.wantErr {
+				if u.Owned || u.DuoNotes != tt.notes {
+					t.Errorf("User.duoAdopt() failed but Owned = %v, DuoNotes = %q", u.Owned, u.DuoNotes)
+				}
+				return
+			}
+			if gotNotes != tt.wantNotes || u.DuoNotes != tt.wantNotes || !u.Owned {
+				t.Errorf("User.duoAdopt() sent notes %q, DuoNotes = %q, Owned = %v, want %q", gotNotes, u.DuoNotes, u.Owned, tt.wantNotes)
+			}
+		})
+	}
+}
+
+func TestUserSet_adoptable(t *testing.T) {
+	u := UserSet{
+		"jsmith":    &User{Username: "jsmith", LDAP: true, Duo: true},
+		"bjones":    &User{Username: "bjones", LDAP: true, Duo: true},
+		"owned":     &User{Username: "owned", LDAP: true, Duo: true, Owned: true},
+		"protected": &User{Username: "protected", LDAP: true, Duo: true, Protected: true},
+		"duoOnly":   &User{Username: "duoOnly", Duo: true},
+		"ldapOnly":  &User{Username: "ldapOnly", LDAP: true},
+	}
+
+	var got []string
+	for _, user := range u.adoptable() {
+		got = append(got, user.Username)
+	}
+	want := []string{"bjones", "jsmith"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UserSet.adoptable() = %v, want %v", got, want)
+	}
+}
+
+func TestUserSet_markSyncDisabled(t *testing.T) {
+	u := UserSet{
+		"deprovisioned": &User{LDAP: true, Duo: true, Username: "deprovisioned", Status: "active", DuoStatus: "disabled"},
+		"admin":         &User{LDAP: true, Duo: true, Username: "admin", Status: "active", DuoStatus: "disabled"},
+	}
+	state := &State{Users: map[string]*UserState{"deprovisioned": {Disabled: true}, "admin": {}}}
+	u.markSyncDisabled(state)
+
+	wants := map[string]bool{"deprovisioned": true, "admin": false}
+	for name, want := range wants {
+		if u[name].SyncDisabled != want || u[name].NeedsUpdate != want {
+			t.Errorf("UserSet.markSyncDisabled() %s SyncDisabled = %v, NeedsUpdate = %v, want %v", name, u[name].SyncDisabled, u[name].NeedsUpdate, want)
+		}
+	}
+}
+
+func TestUser_groupChanges(t *testing.T) {
+	groups := GroupSet{
+		"admins": &Group{LDAP: true, Duo: true, Managed: true, Name: "admins", DN: "cn=admins,ou=groups,dc=example,dc=com"},
+		"users":  &Group{LDAP: true, Duo: true, Managed: true, Name: "users", DN: "cn=users,ou=groups,dc=example,dc=com"},
+		"vpn":    &Group{LDAP: true, Duo: true, Managed: true, Name: "vpn", DN: "cn=vpn,ou=groups,dc=example,dc=com"},
+		"manual": &Group{Duo: true, Name: "manual"},
+	}
+
+	user := &User{
+		LDAP:      true,
+		Username:  "jsmith",
+		Groups:    []string{"CN=admins,ou=groups,dc=example,dc=com", "cn=vpn,ou=groups,dc=example,dc=com", "cn=unknown,dc=example,dc=com"},
+		DuoGroups: []string{"users", "vpn", "manual"},
+	}
+	groups.resolveMembers(UserSet{"jsmith": user}, MembershipMemberOf)
+
+	add, remove := user.groupChanges(groups)
+	if !reflect.DeepEqual(add, []*Group{groups["admins"]}) {
+		t.Errorf("User.groupChanges() add = %v, want [admins]", add)
+	}
+	if !reflect.DeepEqual(remove, []*Group{groups["users"]}) {
+		t.Errorf("User.groupChanges() remove = %v, want [users]", remove)
+	}
+}
+
+func TestUserSet_filterGroups(t *testing.T) {
+	duoUsers := &Group{LDAP: true, Name: "duo-users"}
+	vpnUsers := &Group{LDAP: true, Name: "vpn-users"}
+	contractors := &Group{LDAP: true, Name: "contractors"}
+
+	newUserSet := func() UserSet {
+		return UserSet{
+			"duo":        &User{LDAP: true, Username: "duo", MemberOf: map[string]bool{"duo-users": true}},
+			"vpn":        &User{LDAP: true, Username: "vpn", MemberOf: map[string]bool{"vpn-users": true}},
+			"contractor": &User{LDAP: true, Username: "contractor", MemberOf: map[string]bool{"duo-users": true, "contractors": true}},
+			"other":      &User{LDAP: true, Username: "other", MemberOf: map[string]bool{}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		include []*Group
+		exclude []*Group
+		want    []string
+	}{
+		{name: "No filters", want: []string{"contractor", "duo", "other", "vpn"}},
+		{name: "Include", include: []*Group{duoUsers, vpnUsers}, want: []string{"contractor", "duo", "vpn"}},
+		{name: "Exclude", exclude: []*Group{contractors}, want: []string{"duo", "other", "vpn"}},
+		{name: "Include and exclude", include: []*Group{duoUsers}, exclude: []*Group{contractors}, want: []string{"duo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newUserSet()
+			u.filterGroups(tt.include, tt.exclude)
+
+			got := []string{}
+			for name := range u {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UserSet.filterGroups() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}